@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bigjimnolan/softrains/frigateservice"
+	"github.com/bigjimnolan/softrains/hubitatservice"
+	"github.com/rs/zerolog/log"
+)
+
+// absenceCheckInterval is how often absence rules are evaluated.
+const absenceCheckInterval = 10 * time.Second
+
+var (
+	// lastSeen holds the last detection time for every zone:label and camera:label key.
+	lastSeen      = make(map[string]time.Time)
+	lastSeenMutex sync.Mutex
+	// lastSeenStart stands in for keys that have not been seen since startup.
+	lastSeenStart = time.Now()
+	// absenceRules are guarded by actionsListMutex along with the other action lists.
+	absenceRules []absenceRule
+)
+
+// absenceRule fires its actions once a source has gone unseen for the whole window.
+type absenceRule struct {
+	source  string
+	match   func(zone string, label string) bool
+	window  time.Duration
+	actions []hubitatservice.ActionType
+	// firedFor is the last-seen time the rule already fired for, so it fires once per
+	// absence and re-arms when a new detection arrives.
+	firedFor time.Time
+}
+
+// HandleDetection records a Frigate detection for absence tracking and calls the
+// actions for each zone the object is in.
+func HandleDetection(zones []string, event frigateservice.EventDetails) {
+	now := time.Now()
+	lastSeenMutex.Lock()
+	if event.Camera != "" {
+		lastSeen[event.Camera+":"+event.Label] = now
+	}
+	for _, zone := range zones {
+		lastSeen[zone+":"+event.Label] = now
+	}
+	lastSeenMutex.Unlock()
+
+	trigger := hubitatservice.TriggerEvent{
+		Camera:      event.Camera,
+		Label:       event.Label,
+		Score:       event.TopScore,
+		EventID:     event.ID,
+		SnapshotURL: frigateService.SnapshotURL(event.ID),
+		Time:        now,
+	}
+	if trigger.Score == 0 {
+		trigger.Score = event.Score
+	}
+	if event.SubLabel != nil {
+		trigger.SubLabel = *event.SubLabel
+	}
+	if event.FrameTime > 0 {
+		trigger.Time = time.Unix(0, int64(event.FrameTime*float64(time.Second)))
+	}
+
+	for _, zone := range zones {
+		log.Info().Msgf("Executing callback for zone: %s\n", zone)
+		trigger.Zone = zone
+		CallActions(zone+":"+event.Label, trigger)
+	}
+}
+
+// lastSeenFor returns the latest detection matching a rule, or the startup time
+// when nothing matching has been seen.
+func lastSeenFor(match func(string, string) bool) time.Time {
+	lastSeenMutex.Lock()
+	defer lastSeenMutex.Unlock()
+
+	latest := lastSeenStart
+	for key, seen := range lastSeen {
+		zone, label := splitSource(key)
+		if match(zone, label) && seen.After(latest) {
+			latest = seen
+		}
+	}
+	return latest
+}
+
+// checkAbsences fires every absence rule whose window has passed without a detection.
+func checkAbsences(now time.Time) {
+	var due [][]hubitatservice.ActionType
+
+	actionsListMutex.Lock()
+	for i := range absenceRules {
+		rule := &absenceRules[i]
+		seen := lastSeenFor(rule.match)
+		if now.Sub(seen) < rule.window || seen.Equal(rule.firedFor) {
+			continue
+		}
+		log.Info().Msgf("Nothing seen for %v since %v, firing absence rule", rule.source, seen)
+		rule.firedFor = seen
+		actions := make([]hubitatservice.ActionType, len(rule.actions))
+		for i, action := range rule.actions {
+			action.Trigger = hubitatservice.TriggerEvent{Time: now}
+			actions[i] = action
+		}
+		due = append(due, actions)
+	}
+	actionsListMutex.Unlock()
+
+	for _, actions := range due {
+		mailChannel <- actions
+	}
+}
+
+// startAbsenceScheduler evaluates absence rules on a fixed interval.
+func startAbsenceScheduler() {
+	ticker := time.NewTicker(absenceCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		checkAbsences(now)
+	}
+}
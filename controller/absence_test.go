@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigjimnolan/softrains/hubitatservice"
+)
+
+func TestCompileSourceWithoutLabel(t *testing.T) {
+	match, err := compileSource("Driveway", mergeLabelGroups(nil))
+	if err != nil {
+		t.Fatalf("compileSource: %v", err)
+	}
+	for _, c := range []struct {
+		zone, label string
+		want        bool
+	}{
+		{"Driveway", "car", true},
+		{"Driveway", "person", true},
+		{"Garden", "car", false},
+	} {
+		if got := match(c.zone, c.label); got != c.want {
+			t.Errorf("match(%q, %q) = %v, want %v", c.zone, c.label, got, c.want)
+		}
+	}
+}
+
+// firedAt reports whether checkAbsences sent any actions at the given time.
+func firedAt(now time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		checkAbsences(now)
+		close(done)
+	}()
+	select {
+	case <-mailChannel:
+		<-done
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func TestAbsenceRuleWithoutLabelRearms(t *testing.T) {
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	match, err := compileSource("driveway_cam", mergeLabelGroups(nil))
+	if err != nil {
+		t.Fatalf("compileSource: %v", err)
+	}
+	lastSeenStart = start
+	lastSeen = make(map[string]time.Time)
+	absenceRules = []absenceRule{{
+		source:  "driveway_cam",
+		match:   match,
+		window:  time.Hour,
+		actions: []hubitatservice.ActionType{{DeviceId: 303, PrimaryAction: "notify"}},
+	}}
+	t.Cleanup(func() { absenceRules = nil })
+
+	if !firedAt(start.Add(2 * time.Hour)) {
+		t.Fatal("rule did not fire after the window from startup")
+	}
+	if firedAt(start.Add(3 * time.Hour)) {
+		t.Fatal("rule fired twice for the same quiet period")
+	}
+
+	lastSeen["driveway_cam:car"] = start.Add(4 * time.Hour)
+	if firedAt(start.Add(4*time.Hour + 30*time.Minute)) {
+		t.Fatal("rule fired within the window after a detection")
+	}
+	if !firedAt(start.Add(6 * time.Hour)) {
+		t.Fatal("rule did not re-arm after a detection on the camera")
+	}
+}
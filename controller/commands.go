@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bigjimnolan/softrains/uiservice"
+	"github.com/rs/zerolog/log"
+)
+
+// mqttCommandPrefix is the topic root for commands sent to SoftRains over MQTT.
+const mqttCommandPrefix = "softrains/"
+
+// handleMQTTCommand is called by the MQTT service for every message published under
+// softrains/#. Supported topics:
+//
+//	softrains/scene/run            payload: scene name
+//	softrains/rule/<id>/enable
+//	softrains/rule/<id>/disable
+//	softrains/rule/<id>/snooze     payload: duration, e.g. 3h
+//	softrains/rule/<id>/unsnooze
+func handleMQTTCommand(topic string, payload []byte) {
+	command := strings.TrimPrefix(topic, mqttCommandPrefix)
+	log.Debug().Msgf("MQTT command: %v payload: %s", command, payload)
+
+	if ruleCommand, ok := strings.CutPrefix(command, "rule/"); ok {
+		handleRuleCommand(ruleCommand, strings.TrimSpace(string(payload)))
+		return
+	}
+
+	switch command {
+	case "scene/run":
+		name := strings.TrimSpace(string(payload))
+		if name == "" {
+			log.Warn().Msg("MQTT scene/run received without a scene name")
+			return
+		}
+		updateChannel <- uiservice.UpdateMsg{UpdateType: "sceneRun", UpdateData: name}
+	default:
+		log.Warn().Msgf("Unknown MQTT command topic: %v", topic)
+	}
+}
+
+// handleRuleCommand applies an enable, disable or snooze command of the form
+// <id>/<command> to a rule in the actions file.
+func handleRuleCommand(ruleCommand string, payload string) {
+	ruleID, command, ok := strings.Cut(ruleCommand, "/")
+	if !ok {
+		log.Warn().Msgf("MQTT rule command missing action: %v", ruleCommand)
+		return
+	}
+
+	var err error
+	var snooze time.Duration
+	if command == uiservice.RuleSnooze {
+		snooze, err = time.ParseDuration(payload)
+		if err != nil {
+			log.Warn().Msgf("MQTT rule snooze has invalid duration %q: %v", payload, err)
+			return
+		}
+	}
+
+	err = uiService.RuleCommand(ruleID, command, snooze)
+	if err != nil {
+		log.Warn().Msgf("MQTT rule command %v failed: %v", ruleCommand, err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,11 +21,27 @@ var (
 	mailChannel           = make(chan []hubitatservice.ActionType)
 	updateChannel         = make(chan uiservice.UpdateMsg)
 	hserviceUpdateChannel = make(chan hubitatservice.HubitatDeviceInfo)
+	hserviceConfigChannel = make(chan hubitatservice.HubitatServiceConfig)
 	actionsList           = make(map[string][]hubitatservice.ActionType)
-	actionsListMutex      sync.Mutex
+	actionPatterns        []actionPattern
+	labelGroups           = mergeLabelGroups(nil)
+	scenes                = make(map[string]hubitatservice.Scene)
+	conflictLog           = hubitatservice.NewConflictLog(100)
+	failureLog            = hubitatservice.NewFailureLog(100)
+	resultHistory         = hubitatservice.NewResultHistory(500)
+	deviceStates          = hubitatservice.NewDeviceStates()
+	breaker               = hubitatservice.NewCircuitBreaker()
+	uiService             *uiservice.UIService
+	frigateService        frigateservice.FrigateService
+	// runningHubitatConfig is the HubitatConfig the running actions are validated against.
+	// It has its own copy of the device map, as HubitatService updates the original.
+	runningHubitatConfig hubitatservice.HubitatServiceConfig
+	// activeRules holds the IDs of the enabled rules in the running actions.
+	activeRules      = make(map[string]bool)
+	actionsListMutex sync.Mutex
 )
 
-func startControllerChannel(actionsListLocation string) {
+func startControllerChannel(configPath string, actionsListLocation string) {
 	// This function is used to start the controller channel
 	// It is used to send actions to the hubitat service
 	// and updates to the UI service
@@ -40,12 +55,62 @@ func startControllerChannel(actionsListLocation string) {
 				log.Warn().Msg("UpdateData is not of type HubitatDeviceInfo")
 				break
 			}
+			// Devices from the UI still carry the <access_token> placeholder and ${ENV} references
+			if deviceUpdate.DeviceURL != nil {
+				*deviceUpdate.DeviceURL = expandEnv(*deviceUpdate.DeviceURL)
+			}
+			if deviceUpdate.PostBody != nil {
+				*deviceUpdate.PostBody = expandEnv(*deviceUpdate.PostBody)
+			}
+			deviceUpdate.Token = expandEnv(deviceUpdate.Token)
+			getSecrets(map[int]hubitatservice.HubitatDeviceInfo{deviceUpdate.DeviceID: deviceUpdate})
+			actionsListMutex.Lock()
+			runningHubitatConfig.HubitatDevices[deviceUpdate.DeviceID] = deviceUpdate
+			actionsListMutex.Unlock()
 			hserviceUpdateChannel <- deviceUpdate
 		case "action":
 			err := getActions(actionsListLocation)
 			if err != nil {
 				log.Error().Msgf("Failed to get actions: %v", err)
 			}
+		case "scene":
+			scene, ok := update.UpdateData.(hubitatservice.Scene)
+			if !ok {
+				log.Warn().Msg("UpdateData is not of type Scene")
+				break
+			}
+			updateScene(scene, actionsListLocation)
+		case "reload":
+			err := reloadConfig(configPath, actionsListLocation)
+			if err != nil {
+				log.Error().Msgf("Reload failed, keeping the running config:\n%v", err)
+			}
+		case "hubitatEvent":
+			event, ok := update.UpdateData.(hubitatservice.DeviceEvent)
+			if !ok {
+				log.Warn().Msg("UpdateData is not of type DeviceEvent")
+				break
+			}
+			log.Debug().Msgf("Hubitat event: device %v %v=%v", event.DeviceID, event.Attribute, event.Value)
+			deviceStates.Update(event)
+			if event.Physical {
+				overrideDevice(event)
+			}
+			CallEventActions(event)
+		case "retryFailed":
+			id, ok := update.UpdateData.(int)
+			if !ok {
+				log.Warn().Msg("UpdateData is not a failed action ID")
+				break
+			}
+			retryFailed(id)
+		case "sceneRun":
+			name, ok := update.UpdateData.(string)
+			if !ok {
+				log.Warn().Msg("UpdateData is not a scene name")
+				break
+			}
+			runScene(name)
 		default:
 			log.Warn().Msgf("Unknown update type: %v", update.UpdateType)
 		}
@@ -53,39 +118,109 @@ func startControllerChannel(actionsListLocation string) {
 }
 
 // Call actions tries to find registered actions, and, if so, run them.
-func CallActions(from string, preProcess bool) {
+// The trigger is attached to each action so its details can be used in templates.
+func CallActions(from string, trigger hubitatservice.TriggerEvent) {
 	log.Debug().Msgf("CallActions called for: %v", from)
-	actions, ok := actionsList[from]
+	found, ok := lookupActions(from)
+
+	// The looked up slices are shared, so the trigger goes on a copy
+	actions := make([]hubitatservice.ActionType, len(found))
+	for i, action := range found {
+		action.Trigger = trigger
+		actions[i] = action
+	}
 	if ok {
 		mailChannel <- actions
 		return
 	}
 
-	log.Debug().Msgf("input device not found: %v\nCalling default actions: \n%v", from, actionsList["default"])
-	mailChannel <- actionsList["default"]
+	if !recordUnmatched(from, time.Now()) {
+		log.Debug().Msgf("input device not found: %v\nNot calling default actions, policy: %v", from, unmatchedPolicy)
+		return
+	}
+	if len(actions) == 0 {
+		log.Debug().Msgf("input device not found: %v\nNo default actions configured", from)
+		return
+	}
+
+	log.Debug().Msgf("input device not found: %v\nCalling default actions: \n%v", from, actions)
+	mailChannel <- actions
+}
+
+// CallEventActions runs the rules triggered by a Hubitat device event. Most events
+// match no rule, so unlike detections they are not counted as unmatched and never
+// run the default rules.
+func CallEventActions(event hubitatservice.DeviceEvent) {
+	key := event.TriggerKey()
+	found, ok := lookupActions(key)
+	if !ok {
+		log.Trace().Msgf("No rules for device event: %v", key)
+		return
+	}
+	log.Debug().Msgf("Device event %v triggered %d actions", key, len(found))
+
+	trigger := event.Trigger()
+	actions := make([]hubitatservice.ActionType, len(found))
+	for i, action := range found {
+		action.Trigger = trigger
+		actions[i] = action
+	}
+	mailChannel <- actions
 }
 
 // startHubitatService creates the inital hubitat connection. This listens on a channel created in main an shared between the services
 func buildHubitatService(hubitatConfig hubitatservice.HubitatServiceConfig) (hubitatservice.HubitatService, error) {
+	for name, scene := range hubitatConfig.Scenes {
+		scene.Name = name
+		scenes[name] = scene
+	}
+
+	actionsListMutex.Lock()
+	runningHubitatConfig = hubitatConfig
+	runningHubitatConfig.Scenes = scenes
+	runningHubitatConfig.HubitatDevices = make(map[int]hubitatservice.HubitatDeviceInfo, len(hubitatConfig.HubitatDevices))
+	for id, device := range hubitatConfig.HubitatDevices {
+		runningHubitatConfig.HubitatDevices[id] = device
+	}
+	actionsListMutex.Unlock()
+
 	err := getActions(hubitatConfig.ActionsListLocation)
 	if err != nil {
 		return hubitatservice.HubitatService{}, err
 	}
+	breaker.Configure(hubitatConfig.CircuitBreakerThreshold, hubitatConfig.CircuitBreakerCooldown.Duration())
 
 	return hubitatservice.HubitatService{
 		HubitatChannel:       &mailChannel,
 		HubitatDeviceList:    hubitatConfig.HubitatDevices,
 		AutomaticAction:      make(map[string]hubitatservice.ActionType),
-		Timeout:              hubitatConfig.TimeoutSeconds,
+		Timeout:              hubitatConfig.Timeout.Duration(),
 		DeviceBackoff:        make(map[int]time.Time),
 		DeviceBackoffEnabled: hubitatConfig.DeviceBackoffEnabled,
 		UpdateChannel:        &hserviceUpdateChannel,
+		ConfigChannel:        &hserviceConfigChannel,
+		ManualOverride:       hubitatConfig.ManualOverride.Duration(),
+		ManualOverrideUntil:  make(map[int]time.Time),
+		Conflicts:            conflictLog,
+		Breaker:              breaker,
+		Failures:             failureLog,
+		Results:              resultHistory,
+		States:               deviceStates,
+		Scheduler:            hubitatservice.NewScheduler(hubitatservice.SystemClock),
+		Calls:                hubitatservice.NewDeviceCalls(),
+		State:                hubitatservice.NewStateStore(hubitatConfig.StateFile),
+		OverduePolicy:        hubitatConfig.OverduePolicy,
+		OverdueMaxAge:        hubitatConfig.OverdueMaxAge.Duration(),
+		RuleActive:           ruleActive,
 	}, nil
 }
 
 func getSecrets(hubDevices map[int]hubitatservice.HubitatDeviceInfo) {
 	for _, device := range hubDevices {
-		tokenString := "HUBITAT_ACCESS_TOKEN_" + strconv.Itoa(device.APIID)
+		if device.DeviceURL == nil {
+			continue
+		}
+		tokenString := hubitatservice.AccessTokenVar(device.APIID)
 		token := os.Getenv(tokenString)
 		if token == "" {
 			log.Warn().Msgf("Could not find token at: %v\n", tokenString)
@@ -96,57 +231,216 @@ func getSecrets(hubDevices map[int]hubitatservice.HubitatDeviceInfo) {
 }
 
 func buildSoftRains() (*SoftRainsConfig, error) {
-	softRains, err := os.Open(os.Getenv("SOFTRAINS_CONFIG_FILE"))
-	if err != nil {
+	configPath := os.Getenv("SOFTRAINS_CONFIG_FILE")
+	if _, err := os.Stat(configPath); err != nil {
 		log.Fatal().Msgf("Config File not found, check location set at Environment Variable: SOFTRAINS_CONFIG_FILE\n%v", err)
 	}
-	defer softRains.Close()
 
-	// Decode the JSON data into a struct
-	var softRainsConfig SoftRainsConfig
-	decoder := json.NewDecoder(softRains)
-	err = decoder.Decode(&softRainsConfig)
+	err := migrateConfig(configPath)
+	if err != nil {
+		return &SoftRainsConfig{}, err
+	}
+
+	softRainsConfig, err := loadSoftRains(configPath)
+	if err != nil {
+		return &SoftRainsConfig{}, err
+	}
+
+	err = validateSoftRains(configPath, softRainsConfig).Err()
 	if err != nil {
 		return &SoftRainsConfig{}, err
 	}
 
 	getSecrets(softRainsConfig.HubitatConfig.HubitatDevices)
+	return softRainsConfig, nil
+}
+
+// loadSoftRains decodes the JSON or YAML config file, with environment overrides applied,
+// without validating it or applying secrets.
+func loadSoftRains(configPath string) (*SoftRainsConfig, error) {
+	data, err := hubitatservice.ReadConfigFile(configPath)
+	if err != nil {
+		return &SoftRainsConfig{}, err
+	}
+	return decodeSoftRains(data)
+}
+
+// decodeSoftRains decodes a config document read by ReadConfigFile, with environment
+// overrides applied.
+func decodeSoftRains(data []byte) (*SoftRainsConfig, error) {
+	data, err := overlayEnv(data)
+	if err != nil {
+		return &SoftRainsConfig{}, err
+	}
+
+	// Decode the JSON data into a struct; YAML files arrive already converted
+	var softRainsConfig SoftRainsConfig
+	err = json.Unmarshal(data, &softRainsConfig)
+	if err != nil {
+		return &SoftRainsConfig{}, err
+	}
 	return &softRainsConfig, nil
 }
 
 func getActions(actionFilePath string) error {
-	file, err := os.Open(actionFilePath)
+	actionsToParse, err := hubitatservice.LoadActions(actionFilePath)
+	if err != nil {
+		return err
+	}
+
+	actionsListMutex.Lock()
+	config := runningHubitatConfig
+	groups := labelGroups
+	actionsListMutex.Unlock()
+	err = validateRules(actionFilePath, actionsToParse, config, groups).Err()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	actionsToParse := []hubitatservice.ActionInput{}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&actionsToParse)
+	// Build the new lists first so a bad pattern leaves the running actions untouched
+	compiled, err := compileActions(actionsToParse, groups, config.Scenes)
 	if err != nil {
 		return err
 	}
 
 	actionsListMutex.Lock()
 	defer actionsListMutex.Unlock()
-	// Empty the actionsList before reloading
-	for k := range actionsList {
-		delete(actionsList, k)
-	}
+	applyActions(compiled)
+	return nil
+}
+
+// compiledActions are the lookup lists built from an actions file, ready to be swapped in.
+type compiledActions struct {
+	exact    map[string][]hubitatservice.ActionType
+	patterns []actionPattern
+	absences []absenceRule
+	active   map[string]bool
+}
 
+// compileActions turns the rules from an actions file into lookup lists without
+// touching the running ones.
+func compileActions(actionsToParse []hubitatservice.ActionInput, groups map[string][]string, sceneList map[string]hubitatservice.Scene) (compiledActions, error) {
+	exact := make(map[string][]hubitatservice.ActionType)
+	var patterns []actionPattern
+	patternIndex := make(map[string]int)
+	var absences []absenceRule
+	absenceIndex := make(map[string]int)
+	active := make(map[string]bool)
 	for _, action := range actionsToParse {
-		actionsList[action.CameraSource] = append(actionsList[action.CameraSource], hubitatservice.ActionType{
+		if !action.IsEnabled() {
+			log.Debug().Msgf("Skipping disabled rule for %v", action.CameraSource)
+			continue
+		}
+		active[action.ID] = true
+
+		backoff := action.Backoff.Duration()
+		actionTypes := []hubitatservice.ActionType{{
+			Rule:            action.ID,
 			PrimaryAction:   action.PrimaryAction,
 			SecondaryAction: action.SecondaryAction,
 			DeviceId:        action.DeviceID,
-			StartDelay:      time.Duration(action.Delay) * time.Second,
-			BackoffDelay:    *action.Backoff,
-		})
+			StartDelay:      action.Delay.Duration(),
+			BackoffDelay:    backoff,
+			Retrigger:       action.Retrigger,
+			Priority:        action.Priority,
+			Conflict:        action.Conflict,
+		}}
+		var snoozeUntil time.Time
+		if action.SnoozeUntil != nil {
+			snoozeUntil = *action.SnoozeUntil
+		}
+		actionTypes[0].SnoozeUntil = snoozeUntil
+		var when *hubitatservice.StateCondition
+		if action.When != "" {
+			condition, err := hubitatservice.ParseStateCondition(action.When)
+			if err != nil {
+				return compiledActions{}, fmt.Errorf("rule %v when: %w", action.ID, err)
+			}
+			when = &condition
+		}
+		actionTypes[0].When = when
+
+		// A rule naming a scene runs each of the scene's commands instead of a single device
+		if action.Scene != "" {
+			scene, ok := sceneList[action.Scene]
+			if !ok {
+				log.Warn().Msgf("Rule for %v references unknown scene: %v", action.CameraSource, action.Scene)
+				continue
+			}
+			actionTypes = sceneActions(scene, action.Delay.Duration(), backoff)
+			for i := range actionTypes {
+				actionTypes[i].Rule = action.ID
+				actionTypes[i].Retrigger = action.Retrigger
+				actionTypes[i].Priority = action.Priority
+				actionTypes[i].Conflict = action.Conflict
+				actionTypes[i].SnoozeUntil = snoozeUntil
+				actionTypes[i].When = when
+			}
+		}
+
+		// Absence rules fire when their source has not been seen for a while,
+		// so they are kept apart from the detection lookups
+		if action.AbsentFor > 0 {
+			window := action.AbsentFor.Duration()
+			absenceKey := fmt.Sprintf("%v|%v", action.CameraSource, window)
+			idx, ok := absenceIndex[absenceKey]
+			if !ok {
+				match, err := compileSource(action.CameraSource, groups)
+				if err != nil {
+					return compiledActions{}, err
+				}
+				idx = len(absences)
+				absenceIndex[absenceKey] = idx
+				absences = append(absences, absenceRule{source: action.CameraSource, match: match, window: window})
+			}
+			absences[idx].actions = append(absences[idx].actions, actionTypes...)
+			continue
+		}
+
+		if action.CameraSource == "default" || !isPattern(action.CameraSource, groups) {
+			exact[action.CameraSource] = append(exact[action.CameraSource], actionTypes...)
+			continue
+		}
+
+		idx, ok := patternIndex[action.CameraSource]
+		if !ok {
+			match, err := compilePattern(action.CameraSource, groups)
+			if err != nil {
+				return compiledActions{}, err
+			}
+			idx = len(patterns)
+			patternIndex[action.CameraSource] = idx
+			patterns = append(patterns, actionPattern{source: action.CameraSource, match: match})
+		}
+		patterns[idx].actions = append(patterns[idx].actions, actionTypes...)
 	}
+	return compiledActions{exact: exact, patterns: patterns, absences: absences, active: active}, nil
+}
 
-	log.Trace().Msgf("Actions Loaded: %v\n", actionsList)
-	return nil
+// applyActions swaps in compiled lookup lists. The caller holds actionsListMutex.
+func applyActions(compiled compiledActions) {
+	// Keep the fired state across reloads so a reload does not fire the rule again
+	for i := range compiled.absences {
+		for _, previous := range absenceRules {
+			if previous.source == compiled.absences[i].source && previous.window == compiled.absences[i].window {
+				compiled.absences[i].firedFor = previous.firedFor
+			}
+		}
+	}
+
+	actionsList = compiled.exact
+	actionPatterns = compiled.patterns
+	absenceRules = compiled.absences
+	activeRules = compiled.active
+
+	log.Trace().Msgf("Actions Loaded: %v\nPatterns Loaded: %v\nAbsence Rules Loaded: %v\n", actionsList, len(actionPatterns), len(absenceRules))
+}
+
+// ruleActive reports whether a rule is in the running actions and enabled.
+func ruleActive(rule string) bool {
+	actionsListMutex.Lock()
+	defer actionsListMutex.Unlock()
+	return activeRules[rule]
 }
 
 func setLogLevel(logLevel string) {
@@ -164,19 +458,57 @@ func setLogLevel(logLevel string) {
 	fmt.Printf("logLevel: %v\n", zerolog.GlobalLevel())
 }
 
+// registerActuators adds the actuators that need other services. It runs before any
+// config is validated, as validation checks each device's type, and again once the
+// MQTT settings are known.
+func registerActuators(mqttService mqttservice.MQTTService) {
+	// Devices of type mqtt publish through the embedded broker or an external one
+	hubitatservice.RegisterActuator(hubitatservice.DeviceTypeMQTT, hubitatservice.MQTTActuator{Publish: mqttService.Publisher()})
+}
+
 func StartHere() {
+	registerActuators(mqttservice.MQTTService{})
 
 	// This loads the configuration file from the location set in the environment variable
 	// SOFT_RAINS_CONFIG This step also adds the access token to the device URL
 	// for each device in the configuration file
 	// The access token is set in the environment variable: AccessToken<APIID>
+	configPath := os.Getenv("SOFTRAINS_CONFIG_FILE")
 	softRainsConfig, err := buildSoftRains()
 	if err != nil {
-		log.Fatal().Msgf("Config File not found, check location set at Environment Variable: SOFT_RAINS_CONFIG\n%v", err)
+		log.Fatal().Msgf("Config File is not valid, check the file set at Environment Variable: SOFTRAINS_CONFIG_FILE\n%v", err)
 	}
 
 	// Set the log level based on the configuration
 	setLogLevel(softRainsConfig.LogLevel)
+	registerActuators(softRainsConfig.MQTTService)
+	labelGroups = mergeLabelGroups(softRainsConfig.LabelGroups)
+	frigateService = softRainsConfig.FrigateService
+	if softRainsConfig.UnmatchedPolicy != "" {
+		unmatchedPolicy = softRainsConfig.UnmatchedPolicy
+	}
+	unmatchedInterval = softRainsConfig.UnmatchedRateLimit.Duration()
+
+	// The UI service is wired up before anything starts, as MQTT commands are
+	// handed to it to update rules in the actions file
+	uiService = &softRainsConfig.UIService
+	uiService.UpdateChannel = &updateChannel
+	uiService.Conflicts = conflictLog
+	uiService.Failures = failureLog
+	uiService.Results = resultHistory
+	uiService.States = deviceStates
+	uiService.Breaker = breaker
+	uiService.Unmatched = unmatchedDetections
+	uiService.Validate = validateUIChange
+	uiService.LoadConfig = func(data []byte) (hubitatservice.HubitatServiceConfig, error) {
+		config, err := decodeSoftRains(data)
+		return config.HubitatConfig, err
+	}
+	uiService.Hubs = func() []hubitatservice.HubConfig {
+		actionsListMutex.Lock()
+		defer actionsListMutex.Unlock()
+		return runningHubitatConfig.Hubs
+	}
 
 	wg := &sync.WaitGroup{}
 	// Start the controller channel
@@ -184,7 +516,7 @@ func StartHere() {
 	wg.Add(1)
 	go func(actionsListLocation string) {
 		defer wg.Done()
-		startControllerChannel(actionsListLocation)
+		startControllerChannel(configPath, actionsListLocation)
 	}(softRainsConfig.HubitatConfig.ActionsListLocation)
 
 	// Start MQTT service
@@ -192,7 +524,7 @@ func StartHere() {
 	wg.Add(1)
 	go func(ms mqttservice.MQTTService) {
 		defer wg.Done()
-		err := ms.Start()
+		err := ms.Start(handleMQTTCommand)
 		if err != nil {
 			log.Fatal().Msgf("MQTT Service Failed to Start %v", err)
 		}
@@ -205,7 +537,7 @@ func StartHere() {
 	wg.Add(1)
 	go func(fs frigateservice.FrigateService) {
 		defer wg.Done()
-		err := fs.Start(CallActions)
+		err := fs.Start(HandleDetection)
 		if err != nil {
 			log.Fatal().Msgf("Frigate Service Failed to Start %v", err)
 		}
@@ -225,12 +557,29 @@ func StartHere() {
 		hubitatService.Start()
 	}(hubitatService)
 
+	// Start the absence scheduler
+	// This fires rules whose source has gone unseen for their absentFor window
+	log.Info().Msg("Starting absence scheduler")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		startAbsenceScheduler()
+	}()
+
+	// Start the config watcher
+	// This reloads softrains.json and the actions file when they change on disk
+	log.Info().Msg("Starting config watcher")
+	wg.Add(1)
+	go func(actionsListLocation string) {
+		defer wg.Done()
+		startConfigWatcher(configPath, actionsListLocation)
+	}(softRainsConfig.HubitatConfig.ActionsListLocation)
+
 	// Start the UI service
 	log.Info().Msg("Starting UI service")
 	wg.Add(1)
 	go func(ui *uiservice.UIService) {
 		defer wg.Done()
-		ui.UpdateChannel = &updateChannel
 		err := ui.Start()
 		if err != nil {
 			log.Fatal().Msgf("UI Service Failed to Start %v", err)
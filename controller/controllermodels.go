@@ -9,10 +9,16 @@ import (
 
 // SoftRainsConfig is the configuration structure for the SoftRains application
 // It contains the log level, Hubitat configuration, and Frigate service configuration.
+// LabelGroups names sets of labels that can be used in cameraSource patterns, e.g. "vehicle".
+// UnmatchedPolicy and UnmatchedRateLimit decide what happens to detections no rule matches.
 type SoftRainsConfig struct {
-	LogLevel       string                              `json:"LogLevel"`
-	HubitatConfig  hubitatservice.HubitatServiceConfig `json:"HubitatConfig"`
-	FrigateService frigateservice.FrigateService       `json:"FrigateService"`
-	MQTTService    mqttservice.MQTTService             `json:"MQTTService"`
-	UIService      uiservice.UIService                 `json:"UIService"`
+	ConfigVersion      int                                 `json:"ConfigVersion"`
+	LogLevel           string                              `json:"LogLevel"`
+	LabelGroups        map[string][]string                 `json:"LabelGroups"`
+	UnmatchedPolicy    string                              `json:"UnmatchedPolicy"`
+	UnmatchedRateLimit hubitatservice.Duration             `json:"UnmatchedRateLimit"`
+	HubitatConfig      hubitatservice.HubitatServiceConfig `json:"HubitatConfig"`
+	FrigateService     frigateservice.FrigateService       `json:"FrigateService"`
+	MQTTService        mqttservice.MQTTService             `json:"MQTTService"`
+	UIService          uiservice.UIService                 `json:"UIService"`
 }
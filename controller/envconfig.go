@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// envOverlayPrefix starts an environment variable that overrides a config field, with
+// the path to the field separated by double underscores, e.g.
+// SOFTRAINS__FrigateService__MqttURL.
+const envOverlayPrefix = "SOFTRAINS__"
+
+// envReference matches ${NAME} and ${NAME:-default} inside config values.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// overlayEnv applies ${ENV} interpolation and SOFTRAINS__ overrides to a config
+// document, returning the JSON to decode.
+func overlayEnv(data []byte) ([]byte, error) {
+	var config map[string]interface{}
+	err := decodeNumbers(data, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	interpolateEnv(config)
+	err = applyEnvOverlays(config, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(config)
+	return buf.Bytes(), err
+}
+
+// expandEnv replaces ${NAME} references in a value. A variable that is not set is
+// replaced by its default, or left empty with a warning.
+func expandEnv(value string) string {
+	return envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		parts := envReference.FindStringSubmatch(reference)
+		if env, ok := os.LookupEnv(parts[1]); ok {
+			return env
+		}
+		if strings.Contains(reference, ":-") {
+			return parts[2]
+		}
+		log.Warn().Msgf("Environment variable %v is not set", parts[1])
+		return ""
+	})
+}
+
+// interpolateEnv expands ${NAME} references in every string value of a decoded document.
+func interpolateEnv(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return expandEnv(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = interpolateEnv(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = interpolateEnv(item)
+		}
+	}
+	return value
+}
+
+// applyEnvOverlays sets the config fields named by SOFTRAINS__ variables. Path segments
+// match keys without regard to case, and missing objects are created. A value replacing
+// a string stays a string; anything else is read as JSON when it parses as JSON.
+func applyEnvOverlays(config map[string]interface{}, environ []string) error {
+	for _, entry := range environ {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(name, envOverlayPrefix) {
+			continue
+		}
+		path := strings.Split(strings.TrimPrefix(name, envOverlayPrefix), "__")
+
+		fields := config
+		for i, segment := range path {
+			if segment == "" {
+				return fmt.Errorf("%s: empty path segment", name)
+			}
+			key := matchKey(fields, segment)
+			if i == len(path)-1 {
+				fields[key] = overlayValue(fields[key], value)
+				break
+			}
+			next, ok := fields[key].(map[string]interface{})
+			if !ok {
+				if fields[key] != nil {
+					return fmt.Errorf("%s: %s is not an object", name, strings.Join(path[:i+1], "."))
+				}
+				next = make(map[string]interface{})
+				fields[key] = next
+			}
+			fields = next
+		}
+		log.Info().Msgf("Config field %v set from %v", strings.Join(path, "."), name)
+	}
+	return nil
+}
+
+// matchKey finds the existing key for a path segment, ignoring case, as the
+// config decoder does. A segment that matches no key is used as it is.
+func matchKey(fields map[string]interface{}, segment string) string {
+	if _, ok := fields[segment]; ok {
+		return segment
+	}
+	for key := range fields {
+		if strings.EqualFold(key, segment) {
+			return key
+		}
+	}
+	return segment
+}
+
+func overlayValue(current interface{}, value string) interface{} {
+	if _, ok := current.(string); ok {
+		return value
+	}
+	var parsed interface{}
+	if err := decodeNumbers([]byte(value), &parsed); err == nil {
+		return parsed
+	}
+	return value
+}
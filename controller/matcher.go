@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/bigjimnolan/softrains/hubitatservice"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultLabelGroups are the label groups available without any configuration.
+// Entries in SoftRainsConfig.LabelGroups replace a default group of the same name.
+var defaultLabelGroups = map[string][]string{
+	"vehicle": {"car", "truck", "motorcycle"},
+}
+
+// actionPattern is a precompiled cameraSource pattern and the actions it triggers.
+type actionPattern struct {
+	source  string
+	match   func(zone string, label string) bool
+	actions []hubitatservice.ActionType
+}
+
+// splitSource breaks a "zone:label" key on its last colon.
+// A key without a colon is treated as a zone with any label.
+func splitSource(source string) (string, string) {
+	idx := strings.LastIndex(source, ":")
+	if idx < 0 {
+		return source, "*"
+	}
+	return source[:idx], source[idx+1:]
+}
+
+// isPattern reports whether a cameraSource needs pattern matching rather than an exact lookup.
+// Patterns are "re:<regex>", globs using * ? or [...], or a label part naming a label group.
+func isPattern(source string, groups map[string][]string) bool {
+	if strings.HasPrefix(source, "re:") {
+		return true
+	}
+	if strings.ContainsAny(source, "*?[") {
+		return true
+	}
+	_, label := splitSource(source)
+	_, ok := groups[label]
+	return ok
+}
+
+// compilePattern builds the matcher for a cameraSource pattern.
+func compilePattern(source string, groups map[string][]string) (func(string, string) bool, error) {
+	if expr, ok := strings.CutPrefix(source, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("cameraSource %q: %w", source, err)
+		}
+		return func(zone string, label string) bool {
+			return re.MatchString(zone + ":" + label)
+		}, nil
+	}
+
+	zonePattern, labelPattern := splitSource(source)
+	if _, err := path.Match(zonePattern, ""); err != nil {
+		return nil, fmt.Errorf("cameraSource %q: %w", source, err)
+	}
+
+	if members, ok := groups[labelPattern]; ok {
+		labels := make(map[string]bool, len(members))
+		for _, member := range members {
+			labels[member] = true
+		}
+		return func(zone string, label string) bool {
+			ok, _ := path.Match(zonePattern, zone)
+			return ok && labels[label]
+		}, nil
+	}
+
+	if _, err := path.Match(labelPattern, ""); err != nil {
+		return nil, fmt.Errorf("cameraSource %q: %w", source, err)
+	}
+	return func(zone string, label string) bool {
+		zoneOk, _ := path.Match(zonePattern, zone)
+		labelOk, _ := path.Match(labelPattern, label)
+		return zoneOk && labelOk
+	}, nil
+}
+
+// compileSource builds a matcher for any cameraSource, exact or pattern. A source
+// without a colon, such as "Driveway", names a zone or camera with any label.
+func compileSource(source string, groups map[string][]string) (func(string, string) bool, error) {
+	if isPattern(source, groups) || !strings.Contains(source, ":") {
+		return compilePattern(source, groups)
+	}
+	return func(zone string, label string) bool {
+		return zone+":"+label == source
+	}, nil
+}
+
+// mergeLabelGroups combines the default label groups with those from the config file.
+func mergeLabelGroups(configured map[string][]string) map[string][]string {
+	groups := make(map[string][]string, len(defaultLabelGroups)+len(configured))
+	for name, members := range defaultLabelGroups {
+		groups[name] = members
+	}
+	for name, members := range configured {
+		groups[name] = members
+	}
+	return groups
+}
+
+// lookupActions finds the actions for a zone:label key or a hubitat: device event key.
+// Exact matches win over patterns, and patterns win over the "default" entry.
+// Patterns only match keys of their own kind, so a detection pattern such as *:*
+// is not triggered by device events.
+func lookupActions(from string) ([]hubitatservice.ActionType, bool) {
+	actionsListMutex.Lock()
+	defer actionsListMutex.Unlock()
+
+	if actions, ok := actionsList[from]; ok {
+		return actions, true
+	}
+
+	zone, label := splitSource(from)
+	isEvent := strings.HasPrefix(from, hubitatservice.HubitatTriggerPrefix)
+	var matched []hubitatservice.ActionType
+	for _, pattern := range actionPatterns {
+		if strings.HasPrefix(pattern.source, hubitatservice.HubitatTriggerPrefix) != isEvent {
+			continue
+		}
+		if pattern.match(zone, label) {
+			log.Debug().Msgf("%v matched pattern: %v", from, pattern.source)
+			matched = append(matched, pattern.actions...)
+		}
+	}
+	if len(matched) > 0 {
+		return matched, true
+	}
+
+	return actionsList["default"], false
+}
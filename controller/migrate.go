@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/bigjimnolan/softrains/hubitatservice"
+	"github.com/rs/zerolog/log"
+)
+
+// currentConfigVersion is the ConfigVersion written by this release.
+// Version 2 changed every timing field to a duration, with bare numbers meaning seconds.
+const currentConfigVersion = 2
+
+// migrateConfig upgrades softrains.json and the actions file it points to from older
+// config versions, keeping a .v1.bak copy of each. Files already at the current
+// version are left alone.
+func migrateConfig(configPath string) error {
+	// YAML support arrived with version 2, so YAML files never need migrating
+	if hubitatservice.IsYAML(configPath) {
+		return nil
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	err = decodeNumbers(data, &config)
+	if err != nil {
+		return err
+	}
+	if version, ok := config["ConfigVersion"].(json.Number); ok {
+		if n, _ := version.Int64(); n >= currentConfigVersion {
+			return nil
+		}
+	}
+
+	log.Warn().Msgf("Migrating %v to config version %d", configPath, currentConfigVersion)
+	hubitatConfig, _ := config["HubitatConfig"].(map[string]interface{})
+	if hubitatConfig != nil {
+		if actionsPath, ok := hubitatConfig["ActionsListLocation"].(string); ok && actionsPath != "" && !hubitatservice.IsYAML(actionsPath) {
+			err = migrateActions(actionsPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		// TimeoutSeconds becomes Timeout, now that the unit is part of the value
+		if timeout, ok := hubitatConfig["TimeoutSeconds"]; ok {
+			hubitatConfig["Timeout"] = secondsToDuration(timeout)
+			delete(hubitatConfig, "TimeoutSeconds")
+		}
+		convertSeconds(hubitatConfig, "ManualOverride")
+		devices, _ := hubitatConfig["HubitatDevices"].(map[string]interface{})
+		for _, device := range devices {
+			if device, ok := device.(map[string]interface{}); ok {
+				convertSeconds(device, "DeviceBackoff")
+			}
+		}
+		scenes, _ := hubitatConfig["Scenes"].(map[string]interface{})
+		for _, scene := range scenes {
+			scene, _ := scene.(map[string]interface{})
+			commands, _ := scene["Commands"].([]interface{})
+			for _, command := range commands {
+				if command, ok := command.(map[string]interface{}); ok {
+					convertSeconds(command, "delay")
+				}
+			}
+		}
+	}
+	convertSeconds(config, "UnmatchedRateLimit")
+	config["ConfigVersion"] = currentConfigVersion
+
+	out, err := encodeIndented(config)
+	if err != nil {
+		return err
+	}
+	return replaceWithBackup(configPath, data, out)
+}
+
+// migrateActions converts the timing fields of every rule. delay and absentFor were
+// whole seconds; backoff was read as a raw time.Duration, so a bare number meant
+// nanoseconds, and it is written out that way to keep today's behavior.
+func migrateActions(actionsPath string) error {
+	data, err := os.ReadFile(actionsPath)
+	if err != nil {
+		return err
+	}
+	var rules []map[string]interface{}
+	err = decodeNumbers(data, &rules)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		convertSeconds(rule, "delay")
+		convertSeconds(rule, "absentFor")
+		if backoff, ok := rule["backoff"].(json.Number); ok {
+			n, err := backoff.Int64()
+			if err != nil {
+				return err
+			}
+			if n != 0 {
+				log.Warn().Msgf("Rule %v: backoff %v was read as nanoseconds, migrated to %v", rule["id"], n, time.Duration(n))
+			}
+			rule["backoff"] = time.Duration(n).String()
+		}
+	}
+
+	// Round trip through the rule type so the file keeps its usual field order
+	converted, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	var actions []hubitatservice.ActionInput
+	err = json.Unmarshal(converted, &actions)
+	if err != nil {
+		return err
+	}
+	out, err := encodeIndented(actions)
+	if err != nil {
+		return err
+	}
+	return replaceWithBackup(actionsPath, data, out)
+}
+
+// convertSeconds rewrites a numeric field holding seconds as a duration string.
+func convertSeconds(fields map[string]interface{}, key string) {
+	if value, ok := fields[key]; ok {
+		fields[key] = secondsToDuration(value)
+	}
+}
+
+func secondsToDuration(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return value
+	}
+	return time.Duration(seconds * float64(time.Second)).String()
+}
+
+func decodeNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// encodeIndented writes JSON without escaping the <action> placeholders in device URLs.
+func encodeIndented(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(v)
+	return buf.Bytes(), err
+}
+
+func replaceWithBackup(path string, original []byte, updated []byte) error {
+	err := os.WriteFile(path+".v1.bak", original, 0644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, updated, 0644)
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"os"
+	"time"
+
+	"github.com/bigjimnolan/softrains/hubitatservice"
+	"github.com/bigjimnolan/softrains/uiservice"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// configPollInterval is how often the config files are checked for changes.
+	configPollInterval = time.Second
+	// configDebounce is how long the files must be left alone before a change is
+	// reloaded, so editors and config tools that write in several steps trigger one reload.
+	configDebounce = 2 * time.Second
+)
+
+// fileStamp identifies a version of a file on disk.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// startConfigWatcher polls softrains.json and the actions files and asks the controller
+// to reload them once a change has settled.
+func startConfigWatcher(configPath string, actionsListLocation string) {
+	paths := watchedFiles(configPath, actionsListLocation, nil)
+	seen := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		seen[path] = statFile(path)
+	}
+
+	var changedAt time.Time
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		// Included files come and go as the include globs match them
+		paths = watchedFiles(configPath, actionsListLocation, paths)
+		for _, path := range paths {
+			stamp := statFile(path)
+			if stamp != seen[path] {
+				log.Debug().Msgf("Config file changed: %v", path)
+				seen[path] = stamp
+				changedAt = now
+			}
+		}
+		if changedAt.IsZero() || now.Sub(changedAt) < configDebounce {
+			continue
+		}
+		changedAt = time.Time{}
+		updateChannel <- uiservice.UpdateMsg{UpdateType: "reload"}
+	}
+}
+
+// watchedFiles lists the config file, the actions file and its includes. While the
+// actions files cannot be read, for example halfway through a write, the previous
+// list is kept.
+func watchedFiles(configPath string, actionsListLocation string, previous []string) []string {
+	files, err := hubitatservice.ActionFiles(actionsListLocation)
+	if err != nil {
+		if previous != nil {
+			return previous
+		}
+		files = []string{actionsListLocation}
+	}
+	return append([]string{configPath}, files...)
+}
+
+// reloadConfig re-reads softrains.json and the actions file together and applies them
+// to the running services. Both files are validated first and nothing is applied if
+// either is invalid, so a bad edit rolls back to the config that is already running.
+func reloadConfig(configPath string, actionsListLocation string) error {
+	softRainsConfig, err := loadSoftRains(configPath)
+	if err != nil {
+		return err
+	}
+	errs := validateSoftRains(configPath, softRainsConfig)
+
+	hubitatConfig := softRainsConfig.HubitatConfig
+	if hubitatConfig.ActionsListLocation != actionsListLocation {
+		log.Warn().Msgf("ActionsListLocation changed to %v, restart to use it", hubitatConfig.ActionsListLocation)
+		hubitatConfig.ActionsListLocation = actionsListLocation
+	}
+	groups := mergeLabelGroups(softRainsConfig.LabelGroups)
+	sceneList := make(map[string]hubitatservice.Scene, len(hubitatConfig.Scenes))
+	for name, scene := range hubitatConfig.Scenes {
+		scene.Name = name
+		sceneList[name] = scene
+	}
+	hubitatConfig.Scenes = sceneList
+
+	actions, err := hubitatservice.LoadActions(actionsListLocation)
+	if err != nil {
+		errs.Add(actionsListLocation, "", "%v", err)
+	} else {
+		errs = append(errs, validateRules(actionsListLocation, actions, hubitatConfig, groups)...)
+	}
+	err = errs.Err()
+	if err != nil {
+		return err
+	}
+	compiled, err := compileActions(actions, groups, sceneList)
+	if err != nil {
+		return err
+	}
+	getSecrets(hubitatConfig.HubitatDevices)
+
+	// HubitatService updates its device map in place, so it gets its own copy
+	serviceConfig := hubitatConfig
+	serviceConfig.HubitatDevices = make(map[int]hubitatservice.HubitatDeviceInfo, len(hubitatConfig.HubitatDevices))
+	for id, device := range hubitatConfig.HubitatDevices {
+		serviceConfig.HubitatDevices[id] = device
+	}
+
+	actionsListMutex.Lock()
+	labelGroups = groups
+	scenes = sceneList
+	runningHubitatConfig = hubitatConfig
+	applyActions(compiled)
+	actionsListMutex.Unlock()
+
+	unmatchedMutex.Lock()
+	unmatchedPolicy = UnmatchedDefault
+	if softRainsConfig.UnmatchedPolicy != "" {
+		unmatchedPolicy = softRainsConfig.UnmatchedPolicy
+	}
+	unmatchedInterval = softRainsConfig.UnmatchedRateLimit.Duration()
+	unmatchedMutex.Unlock()
+
+	setLogLevel(softRainsConfig.LogLevel)
+	hserviceConfigChannel <- serviceConfig
+
+	log.Info().Msgf("Reloaded %v and %v", configPath, actionsListLocation)
+	return nil
+}
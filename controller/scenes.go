@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/bigjimnolan/softrains/hubitatservice"
+	"github.com/rs/zerolog/log"
+)
+
+// sceneActions expands a scene into one action per command. The offset is added to
+// every command delay, so a rule's delay postpones the whole scene.
+func sceneActions(scene hubitatservice.Scene, offset time.Duration, backoff time.Duration) []hubitatservice.ActionType {
+	actions := make([]hubitatservice.ActionType, 0, len(scene.Commands))
+	for _, command := range scene.Commands {
+		actions = append(actions, hubitatservice.ActionType{
+			DeviceId:        command.DeviceID,
+			PrimaryAction:   command.PrimaryAction,
+			SecondaryAction: command.SecondaryAction,
+			StartDelay:      offset + command.Delay.Duration(),
+			BackoffDelay:    backoff,
+		})
+	}
+	return actions
+}
+
+// runScene queues every command of a scene straight away, bypassing the rule lookup
+// and device backoff.
+func runScene(name string) {
+	actionsListMutex.Lock()
+	scene, ok := scenes[name]
+	actionsListMutex.Unlock()
+	if !ok {
+		log.Warn().Msgf("Scene not found: %v", name)
+		return
+	}
+
+	// Scenes run by hand are manual actions, which take over the devices they touch
+	log.Info().Msgf("Running scene: %v", name)
+	actions := sceneActions(scene, 0, 0)
+	for i := range actions {
+		actions[i].Rule = "scene:" + name
+		actions[i].Manual = true
+	}
+	mailChannel <- actions
+}
+
+// overrideDevice starts a manual override for a device changed by hand at the device.
+func overrideDevice(event hubitatservice.DeviceEvent) {
+	mailChannel <- []hubitatservice.ActionType{{
+		Rule:          event.TriggerKey(),
+		DeviceId:      event.DeviceID,
+		PrimaryAction: hubitatservice.ActionOverride,
+		Manual:        true,
+	}}
+}
+
+// retryFailed queues a failed action again with a fresh set of retries.
+func retryFailed(id int) {
+	action, ok := failureLog.Take(id)
+	if !ok {
+		log.Warn().Msgf("Failed action not found: %v", id)
+		return
+	}
+	log.Info().Msgf("Retrying failed action for device %v: %v", action.DeviceId, action.PrimaryAction)
+	action.StartDelay = 0
+	mailChannel <- []hubitatservice.ActionType{action}
+}
+
+// updateScene adds, replaces or (with no commands) removes a scene and reloads the
+// actions so rules referencing it pick up the change.
+func updateScene(scene hubitatservice.Scene, actionsListLocation string) {
+	actionsListMutex.Lock()
+	if len(scene.Commands) == 0 {
+		delete(scenes, scene.Name)
+	} else {
+		scenes[scene.Name] = scene
+	}
+	actionsListMutex.Unlock()
+
+	err := getActions(actionsListLocation)
+	if err != nil {
+		log.Error().Msgf("Failed to get actions: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bigjimnolan/softrains/uiservice"
+)
+
+// Unmatched policies decide what happens to detections that match no rule.
+const (
+	UnmatchedIgnore    = "ignore"    // do nothing
+	UnmatchedDefault   = "default"   // run the "default" rules every time (the default)
+	UnmatchedRateLimit = "ratelimit" // run the "default" rules at most once per UnmatchedRateLimit
+)
+
+// unmatchedLimit caps how many unmatched keys are counted. Keys come straight from
+// Frigate events, so once the limit is reached the key seen longest ago makes room.
+const unmatchedLimit = 200
+
+var (
+	unmatchedCounts   = make(map[string]*uiservice.UnmatchedDetection)
+	unmatchedLastRun  time.Time
+	unmatchedMutex    sync.Mutex
+	unmatchedPolicy   = UnmatchedDefault
+	unmatchedInterval time.Duration
+)
+
+// recordUnmatched counts a key that matched no rule and reports whether the
+// default rules should run for it under the configured policy.
+func recordUnmatched(from string, now time.Time) bool {
+	unmatchedMutex.Lock()
+	defer unmatchedMutex.Unlock()
+
+	detection, ok := unmatchedCounts[from]
+	if !ok {
+		if len(unmatchedCounts) >= unmatchedLimit {
+			forgetOldestUnmatched()
+		}
+		detection = &uiservice.UnmatchedDetection{Key: from}
+		unmatchedCounts[from] = detection
+	}
+	detection.Count++
+	detection.LastSeen = now
+
+	switch unmatchedPolicy {
+	case UnmatchedIgnore:
+		return false
+	case UnmatchedRateLimit:
+		if now.Sub(unmatchedLastRun) < unmatchedInterval {
+			return false
+		}
+		unmatchedLastRun = now
+		return true
+	default:
+		return true
+	}
+}
+
+// forgetOldestUnmatched drops the key seen longest ago. The caller holds unmatchedMutex.
+func forgetOldestUnmatched() {
+	var oldest *uiservice.UnmatchedDetection
+	for _, detection := range unmatchedCounts {
+		if oldest == nil || detection.LastSeen.Before(oldest.LastSeen) {
+			oldest = detection
+		}
+	}
+	if oldest != nil {
+		delete(unmatchedCounts, oldest.Key)
+	}
+}
+
+// unmatchedDetections lists the unmatched keys seen so far, most frequent first.
+func unmatchedDetections() []uiservice.UnmatchedDetection {
+	unmatchedMutex.Lock()
+	defer unmatchedMutex.Unlock()
+
+	detections := make([]uiservice.UnmatchedDetection, 0, len(unmatchedCounts))
+	for _, detection := range unmatchedCounts {
+		detections = append(detections, *detection)
+	}
+	sort.Slice(detections, func(i, j int) bool {
+		if detections[i].Count != detections[j].Count {
+			return detections[i].Count > detections[j].Count
+		}
+		return detections[i].Key < detections[j].Key
+	})
+	return detections
+}
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bigjimnolan/softrains/uiservice"
+)
+
+func TestUnmatchedCountsCapped(t *testing.T) {
+	unmatchedCounts = make(map[string]*uiservice.UnmatchedDetection)
+	t.Cleanup(func() { unmatchedCounts = make(map[string]*uiservice.UnmatchedDetection) })
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+
+	recordUnmatched("busy:person", start)
+	for i := 0; i < unmatchedLimit+50; i++ {
+		now := start.Add(time.Duration(i+1) * time.Second)
+		recordUnmatched(fmt.Sprintf("zone%d:cat", i), now)
+		// A key that keeps being seen is never the one forgotten
+		recordUnmatched("busy:person", now)
+	}
+
+	if len(unmatchedCounts) != unmatchedLimit {
+		t.Fatalf("counted %d keys, want the limit of %d", len(unmatchedCounts), unmatchedLimit)
+	}
+	if _, ok := unmatchedCounts["zone0:cat"]; ok {
+		t.Error("the key seen longest ago was kept")
+	}
+	if busy, ok := unmatchedCounts["busy:person"]; !ok || busy.Count != unmatchedLimit+51 {
+		t.Errorf("busy key = %+v, want it kept with every detection counted", busy)
+	}
+	if _, ok := unmatchedCounts[fmt.Sprintf("zone%d:cat", unmatchedLimit+49)]; !ok {
+		t.Error("the newest key was not counted")
+	}
+}
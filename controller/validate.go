@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/bigjimnolan/softrains/hubitatservice"
+	"github.com/bigjimnolan/softrains/mqttservice"
+)
+
+var validLogLevels = map[string]bool{"": true, "warn": true, "info": true, "debug": true, "trace": true}
+
+// validateSoftRains checks softrains.json as a whole.
+func validateSoftRains(file string, config *SoftRainsConfig) hubitatservice.ValidationErrors {
+	var errs hubitatservice.ValidationErrors
+	if !validLogLevels[config.LogLevel] {
+		errs.Add(file, "LogLevel", "unknown level %q", config.LogLevel)
+	}
+	switch config.UnmatchedPolicy {
+	case "", UnmatchedIgnore, UnmatchedDefault, UnmatchedRateLimit:
+	default:
+		errs.Add(file, "UnmatchedPolicy", "unknown policy %q", config.UnmatchedPolicy)
+	}
+	if config.UnmatchedRateLimit < 0 {
+		errs.Add(file, "UnmatchedRateLimit", "must not be negative, got %v", config.UnmatchedRateLimit)
+	}
+	if config.UnmatchedPolicy == UnmatchedRateLimit && config.UnmatchedRateLimit == 0 {
+		errs.Add(file, "UnmatchedRateLimit", "is required for the %q policy", UnmatchedRateLimit)
+	}
+	for name, members := range config.LabelGroups {
+		if len(members) == 0 {
+			errs.Add(file, "LabelGroups."+name, "must list at least one label")
+		}
+	}
+
+	if config.FrigateService.MqttURL == "" {
+		errs.Add(file, "FrigateService.MqttURL", "is required")
+	}
+	if config.MQTTService.Address == "" {
+		errs.Add(file, "MQTTService.Address", "is required")
+	}
+	if config.UIService.ActionsPath == "" {
+		errs.Add(file, "UIService.ActionsPath", "is required")
+	}
+	if config.UIService.ConfigPath == "" {
+		errs.Add(file, "UIService.ConfigPath", "is required")
+	}
+
+	errs = append(errs, hubitatservice.ValidateServiceConfig(file, config.HubitatConfig)...)
+	return errs
+}
+
+// validateRules checks the rules in an actions file, including that every
+// cameraSource pattern compiles with the configured label groups.
+func validateRules(file string, actions []hubitatservice.ActionInput, config hubitatservice.HubitatServiceConfig, groups map[string][]string) hubitatservice.ValidationErrors {
+	errs := hubitatservice.ValidateActions(file, actions, config)
+	counts := make(map[string]int)
+	for _, action := range actions {
+		ruleFile := file
+		if action.Source != "" {
+			ruleFile = action.Source
+		}
+		i := counts[ruleFile]
+		counts[ruleFile]++
+		if action.CameraSource == "" || action.CameraSource == "default" {
+			continue
+		}
+		_, err := compileSource(action.CameraSource, groups)
+		if err != nil {
+			errs.Add(ruleFile, fmt.Sprintf("rules[%d].cameraSource", i), "%v", err)
+		}
+	}
+	return errs
+}
+
+// validateUIChange is handed to the UI service so every save is checked before it is written.
+func validateUIChange(actions []hubitatservice.ActionInput, config hubitatservice.HubitatServiceConfig) hubitatservice.ValidationErrors {
+	errs := hubitatservice.ValidateServiceConfig(uiService.ConfigPath, config)
+	actionsListMutex.Lock()
+	groups := labelGroups
+	actionsListMutex.Unlock()
+	return append(errs, validateRules(uiService.ActionsPath, actions, config, groups)...)
+}
+
+// Validate checks the config file at configPath and the actions file it points to,
+// printing every problem found. It returns the process exit code for the validate command.
+func Validate(configPath string) int {
+	registerActuators(mqttservice.MQTTService{})
+	softRainsConfig, err := loadSoftRains(configPath)
+	if err != nil {
+		fmt.Printf("%s: %v\n", configPath, err)
+		return 1
+	}
+	groups := mergeLabelGroups(softRainsConfig.LabelGroups)
+
+	if softRainsConfig.ConfigVersion < currentConfigVersion {
+		fmt.Printf("%s is config version %d and will be migrated to version %d on the next start; bare numbers below are read as seconds\n", configPath, softRainsConfig.ConfigVersion, currentConfigVersion)
+	}
+
+	errs := validateSoftRains(configPath, softRainsConfig)
+	actionsPath := softRainsConfig.HubitatConfig.ActionsListLocation
+	actions, err := hubitatservice.ReadActions(actionsPath)
+	if err != nil {
+		errs.Add(actionsPath, "", "%v", err)
+	} else {
+		errs = append(errs, validateRules(actionsPath, actions, softRainsConfig.HubitatConfig, groups)...)
+	}
+
+	if len(errs) > 0 {
+		fmt.Println(errs.Error())
+		fmt.Printf("%d problem(s) found\n", len(errs))
+		return 1
+	}
+	fmt.Printf("%s and %s are valid\n", configPath, actionsPath)
+	return 0
+}
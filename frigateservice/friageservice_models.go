@@ -49,4 +49,7 @@ type FrigateService struct {
 	MqttURL       string
 	MqttPort      string
 	FrigateTopics []string
+	// APIURL is the base URL of the Frigate HTTP API, e.g. http://frigate:5000,
+	// used to build snapshot links for action templates.
+	APIURL string
 }
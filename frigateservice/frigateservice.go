@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"gosrc.io/mqtt"
@@ -63,7 +64,18 @@ func publishToTopic(client *mqtt.Client, topic string) {
 	log.Info().Msgf("Published message to topic %s\n", topic)
 }
 
-func (fs *FrigateService) Start(callBack func(string, bool)) error {
+// SnapshotURL returns the Frigate API link to an event's snapshot, or an empty
+// string when the API URL is not configured.
+func (fs FrigateService) SnapshotURL(eventID string) string {
+	if fs.APIURL == "" || eventID == "" {
+		return ""
+	}
+	return strings.TrimSuffix(fs.APIURL, "/") + "/api/events/" + eventID + "/snapshot.jpg"
+}
+
+// Start subscribes to the Frigate topics and calls callBack with the deduplicated
+// zones and details of each detection event.
+func (fs *FrigateService) Start(callBack func([]string, EventDetails)) error {
 	// Set up the MQTT client
 	client := mqtt.NewClient(fs.MqttURL + ":" + fs.MqttPort)
 	client.ClientID = "MQTT-Sub"
@@ -111,13 +123,18 @@ func (fs *FrigateService) Start(callBack func(string, bool)) error {
 			uniqueZones[zone] = true
 		}
 
-		// Loop through the deduplicated zones and execute the callback
+		zones := make([]string, 0, len(uniqueZones))
 		for zone := range uniqueZones {
-			log.Info().Msgf("Executing callback for zone: %s\n", zone)
-			callBack(zone+":"+cameraDetectEvent.Before.Label, false)
+			zones = append(zones, zone)
 		}
 
-
+		// The label is taken from the before state, as it has always been
+		details := cameraDetectEvent.After
+		details.Label = cameraDetectEvent.Before.Label
+		if details.Camera == "" {
+			details.Camera = cameraDetectEvent.Before.Camera
+		}
+		callBack(zones, details)
 	}
 	return nil
 }
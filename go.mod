@@ -5,12 +5,12 @@ go 1.23
 require (
 	github.com/mochi-mqtt/server/v2 v2.7.9
 	github.com/rs/zerolog v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/rs/xid v1.5.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 require (
@@ -0,0 +1,254 @@
+package hubitatservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// actionsFileMutex serialises reads and writes of the actions file between the
+// controller and the UI service.
+var actionsFileMutex sync.Mutex
+
+// NewRuleID returns a random identifier for a rule.
+func NewRuleID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// EnsureRuleIDs gives every rule without an ID, or with an ID already used by an
+// earlier rule, a new one. It reports whether any rule was changed.
+func EnsureRuleIDs(actions []ActionInput) bool {
+	changed := false
+	seen := make(map[string]bool, len(actions))
+	for i := range actions {
+		if actions[i].ID == "" || seen[actions[i].ID] {
+			actions[i].ID = NewRuleID()
+			changed = true
+		}
+		seen[actions[i].ID] = true
+	}
+	return changed
+}
+
+// actionFile is the object form of an actions file, used when it includes other files.
+// A file with no includes may also be a plain list of rules.
+type actionFile struct {
+	Include []string      `json:"include,omitempty"`
+	Rules   []ActionInput `json:"rules"`
+}
+
+// actionSource is one file in an actions file tree, as it was read.
+type actionSource struct {
+	path     string
+	object   bool
+	include  []string
+	rules    []ActionInput
+	original []byte
+}
+
+// LoadActions reads the rules from the actions file and the files it includes.
+// Rules missing an ID are given one and their files rewritten, so IDs stay the same
+// from then on.
+func LoadActions(path string) ([]ActionInput, error) {
+	actionsFileMutex.Lock()
+	defer actionsFileMutex.Unlock()
+
+	actions, sources, err := readActions(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if EnsureRuleIDs(actions) {
+		log.Info().Msgf("Assigned rule IDs in %v", path)
+		err = writeActions(path, sources, actions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return actions, nil
+}
+
+// ReadActions reads the rules from the actions file and its includes without changing them.
+func ReadActions(path string) ([]ActionInput, error) {
+	actionsFileMutex.Lock()
+	defer actionsFileMutex.Unlock()
+	actions, _, err := readActions(path)
+	return actions, err
+}
+
+// ActionFiles lists the actions file and every file it includes.
+func ActionFiles(path string) ([]string, error) {
+	actionsFileMutex.Lock()
+	defer actionsFileMutex.Unlock()
+	_, sources, err := readActions(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(sources))
+	for i, source := range sources {
+		files[i] = source.path
+	}
+	return files, nil
+}
+
+// readActions reads the actions file tree rooted at path. Each rule's Source is set
+// to the file it came from.
+func readActions(path string) ([]ActionInput, []actionSource, error) {
+	var actions []ActionInput
+	var sources []actionSource
+	err := readActionFile(path, make(map[string]bool), &actions, &sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	return actions, sources, nil
+}
+
+func readActionFile(path string, seen map[string]bool, actions *[]ActionInput, sources *[]actionSource) error {
+	path = filepath.Clean(path)
+	if seen[path] {
+		// Overlapping globs may match a file twice; its rules are only read once
+		log.Debug().Msgf("%s: already included, skipping", path)
+		return nil
+	}
+	seen[path] = true
+
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, err := ReadConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var file actionFile
+	object := !bytes.HasPrefix(bytes.TrimSpace(data), []byte("["))
+	if object {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = json.Unmarshal(data, &file.Rules)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i := range file.Rules {
+		file.Rules[i].Source = path
+	}
+	*actions = append(*actions, file.Rules...)
+	*sources = append(*sources, actionSource{path: path, object: object, include: file.Include, rules: file.Rules, original: original})
+
+	// Includes are relative to the including file and may be globs such as rules.d/*.yaml
+	for _, include := range file.Include {
+		pattern := include
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include %q: %w", path, include, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return fmt.Errorf("%s: include %q: file not found", path, include)
+		}
+		for _, match := range matches {
+			err = readActionFile(match, seen, actions, sources)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SaveActions writes the rules back to the actions file tree. Each rule goes to the
+// file it was read from; new rules go to the actions file itself.
+func SaveActions(path string, actions []ActionInput) error {
+	actionsFileMutex.Lock()
+	defer actionsFileMutex.Unlock()
+
+	_, sources, err := readActions(path)
+	if err != nil {
+		return err
+	}
+	EnsureRuleIDs(actions)
+	return writeActions(path, sources, actions)
+}
+
+// writeActions writes every file in the tree whose rules have changed. Files keep
+// their format and their include list, and YAML files their comments and layout.
+// Each file is replaced in one step, as the reload watcher may read it at any time.
+func writeActions(path string, sources []actionSource, actions []ActionInput) error {
+	root := filepath.Clean(path)
+	known := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		known[source.path] = true
+	}
+	rules := make(map[string][]ActionInput, len(sources))
+	for _, action := range actions {
+		source := action.Source
+		if !known[source] {
+			source = root
+		}
+		rules[source] = append(rules[source], action)
+	}
+
+	for _, source := range sources {
+		fileRules := rules[source.path]
+		if fileRules == nil {
+			fileRules = []ActionInput{}
+		}
+		if sameRules(source.rules, fileRules) {
+			continue
+		}
+		var data []byte
+		var err error
+		if IsYAML(source.path) {
+			data, err = updateYAMLRules(source, fileRules)
+		} else {
+			var value interface{} = fileRules
+			if source.object {
+				value = actionFile{Include: source.include, Rules: fileRules}
+			}
+			data, err = json.MarshalIndent(value, "", "  ")
+		}
+		if err != nil {
+			return err
+		}
+		err = replaceFile(source.path, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameRules reports whether two lists of rules would be saved the same.
+func sameRules(a, b []ActionInput) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+// FindAction returns the index of the rule with the given ID, or -1.
+func FindAction(actions []ActionInput, id string) int {
+	for i, action := range actions {
+		if action.ID == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,197 @@
+package hubitatservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// updateYAMLRules returns a YAML actions file with its rules replaced, editing the
+// file's own node tree so comments, key order and everything outside the rules
+// survive. A rule already in the file keeps its node, and only the fields that
+// changed are rewritten.
+func updateYAMLRules(source actionSource, rules []ActionInput) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(source.original, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.path, err)
+	}
+	if len(doc.Content) == 0 {
+		// An empty file has nothing to keep
+		data, err := json.Marshal(rules)
+		if err != nil {
+			return nil, err
+		}
+		return encodeConfigFile(source.path, data)
+	}
+
+	root := doc.Content[0]
+	list := root
+	if root.Kind == yaml.MappingNode {
+		list = mappingValue(root, "rules")
+		if list == nil {
+			list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "rules"}, list)
+		}
+	}
+	if list.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s: rules are not a list", source.path)
+	}
+
+	existing := matchRules(source.rules, rules, len(list.Content))
+	content := make([]*yaml.Node, len(rules))
+	for i, rule := range rules {
+		node, err := ruleNode(rule)
+		if err != nil {
+			return nil, err
+		}
+		if j := existing[i]; j >= 0 && list.Content[j].Kind == yaml.MappingNode {
+			mergeMapping(list.Content[j], node)
+			node = list.Content[j]
+		}
+		content[i] = node
+	}
+	list.Content = content
+	return encodeYAML(&doc)
+}
+
+// matchRules finds the position in the file of each rule being saved, or -1 for a
+// new rule. Rules are matched by ID; a rule that was read without a usable ID, and
+// has just been given one, keeps its position.
+func matchRules(read []ActionInput, rules []ActionInput, nodes int) []int {
+	existing := make([]int, len(rules))
+	if len(read) != nodes {
+		// The nodes do not line up with the rules, so every rule is written afresh
+		for i := range existing {
+			existing[i] = -1
+		}
+		return existing
+	}
+
+	byID := make(map[string]int, len(read))
+	for j, rule := range read {
+		if _, ok := byID[rule.ID]; !ok && rule.ID != "" {
+			byID[rule.ID] = j
+		}
+	}
+	used := make([]bool, len(read))
+	for i, rule := range rules {
+		existing[i] = -1
+		if j, ok := byID[rule.ID]; ok && !used[j] {
+			existing[i] = j
+			used[j] = true
+		}
+	}
+	for i := range rules {
+		if existing[i] >= 0 || i >= len(read) || used[i] {
+			continue
+		}
+		if j, ok := byID[read[i].ID]; !ok || j != i {
+			existing[i] = i
+			used[i] = true
+		}
+	}
+	return existing
+}
+
+// ruleNode encodes a rule as a YAML mapping, written the same way as its JSON.
+func ruleNode(rule ActionInput) (*yaml.Node, error) {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	blockStyle(&doc)
+	return doc.Content[0], nil
+}
+
+// mergeNode returns original updated to hold the value of updated. Mappings, and
+// lists that keep their length, are merged in place; any other changed value is
+// replaced by updated, which takes over the original's comments.
+func mergeNode(original *yaml.Node, updated *yaml.Node) *yaml.Node {
+	if sameNodeValue(original, updated) {
+		return original
+	}
+	switch {
+	case original.Kind == yaml.MappingNode && updated.Kind == yaml.MappingNode:
+		mergeMapping(original, updated)
+		return original
+	case original.Kind == yaml.SequenceNode && updated.Kind == yaml.SequenceNode && len(original.Content) == len(updated.Content):
+		for i := range original.Content {
+			original.Content[i] = mergeNode(original.Content[i], updated.Content[i])
+		}
+		return original
+	}
+	updated.HeadComment, updated.LineComment, updated.FootComment = original.HeadComment, original.LineComment, original.FootComment
+	return updated
+}
+
+// mergeMapping updates the mapping node to hold the fields of updated. Fields that
+// are unchanged keep their original node, changed ones are merged with mergeNode,
+// and new ones are placed next to the field they follow in updated.
+func mergeMapping(original *yaml.Node, updated *yaml.Node) {
+	var content []*yaml.Node
+	for j := 0; j+1 < len(original.Content); j += 2 {
+		value := mappingValue(updated, original.Content[j].Value)
+		if value == nil {
+			continue
+		}
+		content = append(content, original.Content[j], mergeNode(original.Content[j+1], value))
+	}
+
+	// New fields go in front of the next field the original already has
+	var added []*yaml.Node
+	for i := 0; i+1 < len(updated.Content); i += 2 {
+		key := updated.Content[i]
+		if mappingValue(original, key.Value) == nil {
+			added = append(added, key, updated.Content[i+1])
+			continue
+		}
+		if len(added) > 0 {
+			at := mappingIndex(content, key.Value)
+			content = append(content[:at], append(added, content[at:]...)...)
+			added = nil
+		}
+	}
+	original.Content = append(content, added...)
+}
+
+// mappingValue returns the value of a key in a mapping node, or nil. Keys match
+// case-insensitively, as encoding/json reads them, though an exact match comes first.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if i := mappingIndex(mapping.Content, key); i >= 0 {
+		return mapping.Content[i+1]
+	}
+	return nil
+}
+
+// mappingIndex returns the position of a key among a mapping's key and value nodes, or -1.
+func mappingIndex(content []*yaml.Node, key string) int {
+	for i := 0; i+1 < len(content); i += 2 {
+		if content[i].Value == key {
+			return i
+		}
+	}
+	for i := 0; i+1 < len(content); i += 2 {
+		if strings.EqualFold(content[i].Value, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameNodeValue reports whether two nodes hold the same value, however it is written.
+func sameNodeValue(a, b *yaml.Node) bool {
+	var valueA, valueB interface{}
+	if a.Decode(&valueA) != nil || b.Decode(&valueB) != nil {
+		return false
+	}
+	return reflect.DeepEqual(valueA, valueB)
+}
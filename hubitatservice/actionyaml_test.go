@@ -0,0 +1,193 @@
+package hubitatservice
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const commentedActions = `# Porch lights
+include: []
+rules:
+  # Motion turns the porch light on
+  - id: porch-on
+    deviceId: 101
+    delay: 0s
+    primaryAction: "on" # quoted, or YAML reads a bool
+    secondaryAction: ""
+    cameraSource: front:person
+    backoff: 0s
+  # And off again after a while
+  - id: porch-off
+    deviceId: 101
+    delay: 5m0s
+    primaryAction: "off"
+    secondaryAction: ""
+    cameraSource: front:person
+    backoff: 0s
+  # Gate notice
+  - id: gate
+    deviceId: 202
+    delay: 0s
+    primaryAction: notify
+    secondaryAction: ""
+    cameraSource: gate:*
+    backoff: 0s
+# End of rules
+`
+
+func TestSaveActionsYAMLRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func([]ActionInput) []ActionInput
+		wantIDs  []string
+		keep     []string
+		dropped  []string
+		unchange bool
+	}{
+		{
+			name:     "unchanged",
+			edit:     func(rules []ActionInput) []ActionInput { return rules },
+			wantIDs:  []string{"porch-on", "porch-off", "gate"},
+			unchange: true,
+		},
+		{
+			name: "edit",
+			edit: func(rules []ActionInput) []ActionInput {
+				rules[1].Delay = Duration(10 * 60e9)
+				return rules
+			},
+			wantIDs: []string{"porch-on", "porch-off", "gate"},
+			keep:    []string{"# Porch lights", "# Motion turns the porch light on", "# quoted, or YAML reads a bool", "# And off again after a while", "delay: 10m0s", "# End of rules"},
+			dropped: []string{"delay: 5m0s"},
+		},
+		{
+			name: "add",
+			edit: func(rules []ActionInput) []ActionInput {
+				return append(rules, ActionInput{ID: "garage", DeviceID: 303, PrimaryAction: "open", CameraSource: "drive:car"})
+			},
+			wantIDs: []string{"porch-on", "porch-off", "gate", "garage"},
+			keep:    []string{"# Porch lights", "# Motion turns the porch light on", "# Gate notice", "cameraSource: drive:car"},
+		},
+		{
+			name: "delete",
+			edit: func(rules []ActionInput) []ActionInput {
+				return append(rules[:1], rules[2:]...)
+			},
+			wantIDs: []string{"porch-on", "gate"},
+			keep:    []string{"# Porch lights", "# Motion turns the porch light on", "# Gate notice"},
+			dropped: []string{"porch-off", "# And off again after a while"},
+		},
+		{
+			name: "reorder",
+			edit: func(rules []ActionInput) []ActionInput {
+				return []ActionInput{rules[2], rules[0], rules[1]}
+			},
+			wantIDs: []string{"gate", "porch-on", "porch-off"},
+			keep:    []string{"# Porch lights", "# Motion turns the porch light on", "# And off again after a while", "# Gate notice"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "actions.yaml")
+			err := os.WriteFile(path, []byte(commentedActions), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules, err := ReadActions(path)
+			if err != nil {
+				t.Fatalf("ReadActions: %v", err)
+			}
+
+			err = SaveActions(path, tt.edit(rules))
+			if err != nil {
+				t.Fatalf("SaveActions: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text := string(data)
+			if tt.unchange && text != commentedActions {
+				t.Errorf("unchanged rules rewrote the file:\n%s", text)
+			}
+			for _, want := range tt.keep {
+				if !strings.Contains(text, want) {
+					t.Errorf("saved file lost %q:\n%s", want, text)
+				}
+			}
+			for _, unwanted := range tt.dropped {
+				if strings.Contains(text, unwanted) {
+					t.Errorf("saved file still has %q:\n%s", unwanted, text)
+				}
+			}
+
+			saved, err := ReadActions(path)
+			if err != nil {
+				t.Fatalf("ReadActions after saving: %v", err)
+			}
+			var ids []string
+			for _, rule := range saved {
+				ids = append(ids, rule.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("rule IDs = %v, want %v", ids, tt.wantIDs)
+			}
+			if saved[0].PrimaryAction == "true" {
+				t.Error(`primaryAction "on" was written unquoted`)
+			}
+			leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp"))
+			if len(leftovers) != 0 {
+				t.Errorf("temporary files left behind: %v", leftovers)
+			}
+		})
+	}
+}
+
+func TestWriteConfigFileKeepsYAMLComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "softrains.yaml")
+	original := `# SoftRains settings
+HubitatConfig:
+  # The hub
+  Hubs:
+    home:
+      BaseURL: ${HUB_URL} # set in the environment
+  Scenes:
+    evening:
+      Actions: []
+MQTTConfig:
+  Port: 1883
+`
+	err := os.WriteFile(path, []byte(original), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), `"Port":1883`, `"Port":1884`, 1))
+
+	err = WriteConfigFile(path, data)
+	if err != nil {
+		t.Fatalf("WriteConfigFile: %v", err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# SoftRains settings", "# The hub", "BaseURL: ${HUB_URL} # set in the environment", "Port: 1884"} {
+		if !strings.Contains(string(saved), want) {
+			t.Errorf("saved config lost %q:\n%s", want, saved)
+		}
+	}
+	if strings.Index(string(saved), "HubitatConfig") > strings.Index(string(saved), "MQTTConfig") {
+		t.Errorf("saved config changed the key order:\n%s", saved)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("saved config permissions = %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,184 @@
+package hubitatservice
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Device types pick the Actuator that runs a device's commands.
+const (
+	DeviceTypeMaker   = "maker"   // Hubitat Maker API GET (the default)
+	DeviceTypeWebhook = "webhook" // POST PostBody to DeviceURL (the default for device 0)
+	DeviceTypeMQTT    = "mqtt"    // publish to an MQTT topic
+	DeviceTypeLog     = "log"     // log the command and do nothing else
+)
+
+// Command is a single command for a device, with its templates already rendered.
+type Command struct {
+	PrimaryAction   string
+	SecondaryAction string
+	// URLPrimaryAction and URLSecondaryAction are the actions rendered for a URL:
+	// what their placeholders print is path-escaped, their own text is left as written.
+	URLPrimaryAction   string
+	URLSecondaryAction string
+	// Trigger is the event behind the command, for actuators with templated fields of their own.
+	Trigger TriggerEvent
+}
+
+// Actuator carries out commands on one kind of device. Actuate returns the HTTP
+// status of the call, or 0 for actuators that do not make HTTP calls.
+type Actuator interface {
+	Actuate(device HubitatDeviceInfo, command Command) (int, error)
+	// Validate reports problems with a device's settings for this actuator, keyed by field name.
+	Validate(device HubitatDeviceInfo) map[string]string
+}
+
+var (
+	actuators = map[string]Actuator{
+		DeviceTypeMaker:         makerActuator{},
+		DeviceTypeWebhook:       webhookActuator{},
+		DeviceTypeLog:           logActuator{},
+		DeviceTypeHomeAssistant: homeAssistantActuator{},
+	}
+	actuatorsMutex sync.RWMutex
+)
+
+// RegisterActuator adds or replaces the actuator for a device type.
+func RegisterActuator(deviceType string, actuator Actuator) {
+	actuatorsMutex.Lock()
+	defer actuatorsMutex.Unlock()
+	actuators[deviceType] = actuator
+}
+
+// DeviceTypes lists the registered device types.
+func DeviceTypes() []string {
+	actuatorsMutex.RLock()
+	defer actuatorsMutex.RUnlock()
+	types := make([]string, 0, len(actuators))
+	for deviceType := range actuators {
+		types = append(types, deviceType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func actuatorFor(deviceType string) (Actuator, bool) {
+	actuatorsMutex.RLock()
+	defer actuatorsMutex.RUnlock()
+	actuator, ok := actuators[deviceType]
+	return actuator, ok
+}
+
+// DeviceType returns the device's type. Devices without one keep their old meaning:
+// device 0 is a webhook and every other device is a Maker API device.
+func (d HubitatDeviceInfo) DeviceType() string {
+	if d.Type != "" {
+		return d.Type
+	}
+	if d.DeviceID == 0 {
+		return DeviceTypeWebhook
+	}
+	return DeviceTypeMaker
+}
+
+// actuate runs a command on a device with the actuator registered for its type.
+func actuate(device HubitatDeviceInfo, command Command) (int, error) {
+	actuator, ok := actuatorFor(device.DeviceType())
+	if !ok {
+		return 0, fmt.Errorf("no actuator for device type %q", device.DeviceType())
+	}
+	return actuator.Actuate(device, command)
+}
+
+// makerActuator calls the Hubitat Maker API, filling <action> and <action2> in the URL.
+type makerActuator struct{}
+
+func (makerActuator) Actuate(device HubitatDeviceInfo, command Command) (int, error) {
+	deviceURL := renderURLTemplate(*device.DeviceURL, command.Trigger)
+	return callAction(deviceURL, command.URLPrimaryAction, command.URLSecondaryAction, device.Timeout())
+}
+
+func (makerActuator) Validate(device HubitatDeviceInfo) map[string]string {
+	if device.DeviceURL == nil || *device.DeviceURL == "" {
+		return map[string]string{"DeviceURL": "is required"}
+	}
+	if !strings.Contains(*device.DeviceURL, "<action>") {
+		return map[string]string{"DeviceURL": "must contain <action>"}
+	}
+	return nil
+}
+
+// webhookActuator posts the device's PostBody to its URL.
+type webhookActuator struct{}
+
+func (webhookActuator) Actuate(device HubitatDeviceInfo, command Command) (int, error) {
+	deviceURL := renderURLTemplate(*device.DeviceURL, command.Trigger)
+	postBody := renderTemplate(*device.PostBody, command.Trigger)
+	return callPostAction(deviceURL, postBody, command.URLPrimaryAction, command.SecondaryAction, device.Timeout(), true)
+}
+
+func (webhookActuator) Validate(device HubitatDeviceInfo) map[string]string {
+	problems := make(map[string]string)
+	if device.DeviceURL == nil || *device.DeviceURL == "" {
+		problems["DeviceURL"] = "is required"
+	}
+	if device.PostBody == nil {
+		problems["PostBody"] = "is required for a webhook"
+	}
+	return problems
+}
+
+// logActuator only logs commands, for trying out rules without touching real devices.
+type logActuator struct{}
+
+func (logActuator) Actuate(device HubitatDeviceInfo, command Command) (int, error) {
+	log.Info().Msgf("Device %v (log only): %v %v", device.DeviceID, command.PrimaryAction, command.SecondaryAction)
+	return 0, nil
+}
+
+func (logActuator) Validate(device HubitatDeviceInfo) map[string]string {
+	return nil
+}
+
+// MQTTActuator publishes commands to the device's Topic with its QoS and Retain
+// settings. The payload is the device's PostBody or, without one, the primaryAction.
+// Topic and PostBody are templates, and <action> and <action2> are filled in both.
+type MQTTActuator struct {
+	Publish func(topic string, payload []byte, retain bool, qos byte) error
+}
+
+func (m MQTTActuator) Actuate(device HubitatDeviceInfo, command Command) (int, error) {
+	topic := fillActions(renderTemplate(device.Topic, command.Trigger), command)
+	payload := command.PrimaryAction
+	if device.PostBody != nil {
+		payload = fillActions(renderTemplate(*device.PostBody, command.Trigger), command)
+	}
+	log.Debug().Msgf("Publishing to %v (qos %d, retain %v): %v", topic, device.QoS, device.Retain, payload)
+	return 0, m.Publish(topic, []byte(payload), device.Retain, device.QoS)
+}
+
+func (MQTTActuator) Validate(device HubitatDeviceInfo) map[string]string {
+	problems := make(map[string]string)
+	if device.Topic == "" {
+		problems["Topic"] = "is required for an mqtt device"
+	} else if strings.HasPrefix(device.Topic, "softrains/") {
+		// softrains/# is where the broker takes commands, so devices publish elsewhere
+		problems["Topic"] = "must not be under softrains/, which is reserved for commands"
+	} else if strings.ContainsAny(device.Topic, "+#") {
+		problems["Topic"] = "must not contain the wildcards + or #"
+	}
+	if device.QoS > 2 {
+		problems["QoS"] = fmt.Sprintf("must be 0, 1 or 2, got %d", device.QoS)
+	}
+	return problems
+}
+
+// fillActions replaces the <action> and <action2> placeholders with the command.
+func fillActions(text string, command Command) string {
+	text = strings.Replace(text, "<action>", command.PrimaryAction, 1)
+	return strings.Replace(text, "<action2>", command.SecondaryAction, 1)
+}
@@ -0,0 +1,65 @@
+package hubitatservice
+
+// callOutcome is a finished device call, sent back to the service loop.
+type callOutcome struct {
+	action ActionType
+	device HubitatDeviceInfo
+	result ActionResult
+	err    error
+}
+
+// DeviceCalls tracks the device calls running outside the service loop, so a slow
+// or unreachable device does not hold up everything else. Each device has at most
+// one call at a time, keeping its commands in order; actions that come due while
+// their device is busy wait for the call to finish. Apart from the calls sending
+// their outcome, it is only used from the service's own goroutine.
+type DeviceCalls struct {
+	running map[int]ActionType
+	waiting map[int][]string
+	done    chan callOutcome
+}
+
+// NewDeviceCalls creates a tracker with no calls running.
+func NewDeviceCalls() *DeviceCalls {
+	return &DeviceCalls{
+		running: make(map[int]ActionType),
+		waiting: make(map[int][]string),
+		done:    make(chan callOutcome),
+	}
+}
+
+// busy reports whether a call to the device is running.
+func (c *DeviceCalls) busy(deviceID int) bool {
+	_, ok := c.running[deviceID]
+	return ok
+}
+
+// wait holds a pending action's key until the device's running call finishes.
+func (c *DeviceCalls) wait(deviceID int, key string) {
+	c.waiting[deviceID] = append(c.waiting[deviceID], key)
+}
+
+// start runs the call in its own goroutine and sends its outcome to done.
+func (c *DeviceCalls) start(action ActionType, call func() callOutcome) {
+	c.running[action.DeviceId] = action
+	go func() {
+		c.done <- call()
+	}()
+}
+
+// finish marks the device's call as done and returns the keys that waited for it.
+func (c *DeviceCalls) finish(deviceID int) []string {
+	delete(c.running, deviceID)
+	keys := c.waiting[deviceID]
+	delete(c.waiting, deviceID)
+	return keys
+}
+
+// Running returns the actions whose calls have not finished, keyed by pendingKey.
+func (c *DeviceCalls) Running() map[string]ActionType {
+	running := make(map[string]ActionType, len(c.running))
+	for _, action := range c.running {
+		running[pendingKey(action)] = action
+	}
+	return running
+}
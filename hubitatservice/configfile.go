@@ -0,0 +1,185 @@
+package hubitatservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IsYAML reports whether a config file is YAML, going by its extension.
+func IsYAML(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// ReadConfigFile reads a JSON or YAML config file and returns it as JSON, so every
+// config type is decoded the same way whichever format it was written in.
+func ReadConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !IsYAML(path) {
+		return data, nil
+	}
+
+	var doc interface{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	doc, err = jsonValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// WriteConfigFile writes JSON data to a config file, converting it to YAML first
+// when the file is YAML. A YAML file's own node tree is updated, so its comments,
+// key order and unchanged values are kept. The file is replaced in one step, as
+// the reload watcher may read it at any time.
+func WriteConfigFile(path string, data []byte) error {
+	original, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if IsYAML(path) && len(bytes.TrimSpace(original)) > 0 {
+		data, err = mergeConfigFile(path, original, data)
+	} else {
+		data, err = encodeConfigFile(path, data)
+	}
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, data)
+}
+
+// encodeConfigFile returns JSON data in the format of the file at path.
+func encodeConfigFile(path string, data []byte) ([]byte, error) {
+	if !IsYAML(path) {
+		return data, nil
+	}
+
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	blockStyle(&doc)
+	return encodeYAML(&doc)
+}
+
+// mergeConfigFile returns the YAML file original updated to hold the JSON data.
+func mergeConfigFile(path string, original []byte, data []byte) ([]byte, error) {
+	var doc, updated yaml.Node
+	err := yaml.Unmarshal(original, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	err = yaml.Unmarshal(data, &updated)
+	if err != nil {
+		return nil, err
+	}
+	blockStyle(&updated)
+	if len(doc.Content) == 0 || len(updated.Content) == 0 {
+		return encodeYAML(&updated)
+	}
+	doc.Content[0] = mergeNode(doc.Content[0], updated.Content[0])
+	return encodeYAML(&doc)
+}
+
+// encodeYAML writes a node tree with the indent used for every YAML config file.
+func encodeYAML(doc *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err := encoder.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// replaceFile writes data to a temporary file next to path and renames it over
+// path, so readers see either the old file or the new one and never half of it.
+// An existing file keeps its permissions.
+func replaceFile(path string, data []byte) error {
+	mode := fs.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// jsonValue converts a decoded YAML document into values encoding/json can write.
+// YAML allows non-string map keys, such as the device IDs under HubitatDevices.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(key)] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for i, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+// blockStyle clears the flow and quoting styles the JSON source gave a node tree,
+// so it is written as ordinary block YAML. Strings that need quotes still get them.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
@@ -0,0 +1,66 @@
+package hubitatservice
+
+import (
+	"sync"
+	"time"
+)
+
+// ConflictPriority makes a rule's actions compete with other rules' pending actions
+// for the same device: the higher priority wins and the lower one is dropped.
+const ConflictPriority = "priority"
+
+// ConflictRecord describes an action that lost a conflict and was dropped.
+type ConflictRecord struct {
+	Time            time.Time
+	DeviceID        int
+	Rule            string
+	PrimaryAction   string
+	SecondaryAction string
+	Reason          string
+}
+
+// ConflictLog keeps the most recent dropped actions so they can be shown in the UI.
+type ConflictLog struct {
+	mutex   sync.Mutex
+	size    int
+	records []ConflictRecord
+}
+
+// NewConflictLog creates a log holding at most size records.
+func NewConflictLog(size int) *ConflictLog {
+	return &ConflictLog{size: size}
+}
+
+// Add records a dropped action, discarding the oldest record when full.
+func (cl *ConflictLog) Add(action ActionType, reason string) {
+	if cl == nil {
+		return
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.records = append(cl.records, ConflictRecord{
+		Time:            time.Now(),
+		DeviceID:        action.DeviceId,
+		Rule:            action.Rule,
+		PrimaryAction:   action.PrimaryAction,
+		SecondaryAction: action.SecondaryAction,
+		Reason:          reason,
+	})
+	if len(cl.records) > cl.size {
+		cl.records = cl.records[len(cl.records)-cl.size:]
+	}
+}
+
+// List returns the records, newest first.
+func (cl *ConflictLog) List() []ConflictRecord {
+	if cl == nil {
+		return nil
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	records := make([]ConflictRecord, len(cl.records))
+	for i, record := range cl.records {
+		records[len(cl.records)-1-i] = record
+	}
+	return records
+}
@@ -0,0 +1,239 @@
+package hubitatservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceEvent is an attribute change reported by a hub, such as switch=on.
+type DeviceEvent struct {
+	DeviceID    int
+	Attribute   string
+	Value       string
+	Unit        string
+	DisplayName string
+	Description string
+	// Physical is set when the hub reports the change was made at the device, such
+	// as a switch flipped by hand, rather than by a command.
+	Physical bool
+	Time     time.Time
+}
+
+// HubitatTriggerPrefix starts the cameraSource of rules triggered by device events.
+const HubitatTriggerPrefix = "hubitat:"
+
+// TriggerKey is the cameraSource the event triggers: hubitat:<deviceId>:<attribute>:<value>.
+func (e DeviceEvent) TriggerKey() string {
+	return fmt.Sprintf("%s%d:%s:%s", HubitatTriggerPrefix, e.DeviceID, e.Attribute, e.Value)
+}
+
+// Trigger describes the event for the templates of the actions it triggers.
+func (e DeviceEvent) Trigger() TriggerEvent {
+	return TriggerEvent{
+		DeviceID:  e.DeviceID,
+		Attribute: e.Attribute,
+		Value:     e.Value,
+		Time:      e.Time,
+	}
+}
+
+// makerEvent is the body the Maker API POSTs to its postURL. Depending on the
+// firmware, ids and values arrive as strings or numbers.
+type makerEvent struct {
+	Content struct {
+		Name            string      `json:"name"`
+		Value           interface{} `json:"value"`
+		DisplayName     string      `json:"displayName"`
+		DeviceID        interface{} `json:"deviceId"`
+		DescriptionText string      `json:"descriptionText"`
+		Unit            interface{} `json:"unit"`
+		Type            string      `json:"type"`
+	} `json:"content"`
+}
+
+// ParseMakerEvent reads an event POSTed by the Maker API.
+func ParseMakerEvent(body []byte, now time.Time) (DeviceEvent, error) {
+	var event makerEvent
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return DeviceEvent{}, fmt.Errorf("not a Maker API event: %w", err)
+	}
+	deviceID, err := strconv.Atoi(eventString(event.Content.DeviceID))
+	if err != nil {
+		return DeviceEvent{}, fmt.Errorf("event has no usable deviceId: %v", event.Content.DeviceID)
+	}
+	if event.Content.Name == "" {
+		return DeviceEvent{}, fmt.Errorf("event for device %v has no attribute name", deviceID)
+	}
+	return DeviceEvent{
+		DeviceID:    deviceID,
+		Attribute:   event.Content.Name,
+		Value:       eventString(event.Content.Value),
+		Unit:        eventString(event.Content.Unit),
+		DisplayName: event.Content.DisplayName,
+		Description: event.Content.DescriptionText,
+		Physical:    event.Content.Type == "physical",
+		Time:        now,
+	}, nil
+}
+
+// eventString formats a loosely typed event field, with null as empty.
+func eventString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// AttributeState is the last reported value of one attribute.
+type AttributeState struct {
+	Value   string
+	Unit    string
+	Updated time.Time
+}
+
+// DeviceState is everything a hub has reported about one device.
+type DeviceState struct {
+	DeviceID    int
+	DisplayName string
+	Attributes  map[string]AttributeState
+	Updated     time.Time
+}
+
+// Summary lists the attributes as name=value, sorted by name.
+func (d DeviceState) Summary() string {
+	names := make([]string, 0, len(d.Attributes))
+	for name := range d.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + d.Attributes[name].Value + d.Attributes[name].Unit
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DeviceStates caches the live state of devices from hub events.
+type DeviceStates struct {
+	mutex   sync.RWMutex
+	devices map[int]*DeviceState
+}
+
+// NewDeviceStates creates an empty cache.
+func NewDeviceStates() *DeviceStates {
+	return &DeviceStates{devices: make(map[int]*DeviceState)}
+}
+
+// Update records an event.
+func (ds *DeviceStates) Update(event DeviceEvent) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	state, ok := ds.devices[event.DeviceID]
+	if !ok {
+		state = &DeviceState{DeviceID: event.DeviceID, Attributes: make(map[string]AttributeState)}
+		ds.devices[event.DeviceID] = state
+	}
+	if event.DisplayName != "" {
+		state.DisplayName = event.DisplayName
+	}
+	state.Attributes[event.Attribute] = AttributeState{Value: event.Value, Unit: event.Unit, Updated: event.Time}
+	state.Updated = event.Time
+}
+
+// Attribute returns the last value reported for a device attribute.
+func (ds *DeviceStates) Attribute(deviceID int, attribute string) (string, bool) {
+	if ds == nil {
+		return "", false
+	}
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+	state, ok := ds.devices[deviceID]
+	if !ok {
+		return "", false
+	}
+	value, ok := state.Attributes[attribute]
+	return value.Value, ok
+}
+
+// All returns a copy of every device's state, keyed by device ID.
+func (ds *DeviceStates) All() map[int]DeviceState {
+	if ds == nil {
+		return nil
+	}
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+	all := make(map[int]DeviceState, len(ds.devices))
+	for id, state := range ds.devices {
+		copied := *state
+		copied.Attributes = make(map[string]AttributeState, len(state.Attributes))
+		for name, value := range state.Attributes {
+			copied.Attributes[name] = value
+		}
+		all[id] = copied
+	}
+	return all
+}
+
+// StateCondition limits a rule to times when a device attribute has, or does not
+// have, a value. It is written "<deviceId>:<attribute>=<value>" or with "!=".
+type StateCondition struct {
+	DeviceID  int
+	Attribute string
+	Value     string
+	Negate    bool
+}
+
+// ParseStateCondition reads a rule's when field.
+func ParseStateCondition(text string) (StateCondition, error) {
+	device, rest, ok := strings.Cut(text, ":")
+	if !ok {
+		return StateCondition{}, fmt.Errorf("must look like <deviceId>:<attribute>=<value>, got %q", text)
+	}
+	deviceID, err := strconv.Atoi(strings.TrimSpace(device))
+	if err != nil {
+		return StateCondition{}, fmt.Errorf("device %q is not a number", device)
+	}
+	condition := StateCondition{DeviceID: deviceID}
+	attribute, value, ok := strings.Cut(rest, "!=")
+	if ok {
+		condition.Negate = true
+	} else if attribute, value, ok = strings.Cut(rest, "="); !ok {
+		return StateCondition{}, fmt.Errorf("must compare with = or !=, got %q", text)
+	}
+	condition.Attribute = strings.TrimSpace(attribute)
+	condition.Value = strings.TrimSpace(value)
+	if condition.Attribute == "" {
+		return StateCondition{}, fmt.Errorf("attribute is missing in %q", text)
+	}
+	return condition, nil
+}
+
+func (c StateCondition) String() string {
+	op := "="
+	if c.Negate {
+		op = "!="
+	}
+	return fmt.Sprintf("%d:%s%s%s", c.DeviceID, c.Attribute, op, c.Value)
+}
+
+// Met reports whether the condition holds. Nothing is known about a device until
+// its hub reports it, and an unknown attribute never meets a condition.
+func (c StateCondition) Met(states *DeviceStates) bool {
+	value, ok := states.Attribute(c.DeviceID, c.Attribute)
+	if !ok {
+		return false
+	}
+	return (value == c.Value) != c.Negate
+}
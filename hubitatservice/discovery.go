@@ -0,0 +1,151 @@
+package hubitatservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HubConfig is a Hubitat Maker API instance that devices can be imported from.
+// Its access token is read from HUBITAT_ACCESS_TOKEN_<APIId>, like device URLs.
+type HubConfig struct {
+	APIID int `json:"APIId"`
+	// URL is the Maker API base, e.g. http://hubitat.local/apps/api/200.
+	URL string `json:"URL"`
+	// Name is shown in the UI; the URL is used when it is empty.
+	Name string `json:"Name,omitempty"`
+}
+
+// AccessTokenVar is the environment variable holding the token for a Maker API instance.
+func AccessTokenVar(apiID int) string {
+	return "HUBITAT_ACCESS_TOKEN_" + strconv.Itoa(apiID)
+}
+
+// DisplayName is the hub's Name, or its URL when it has none.
+func (hub HubConfig) DisplayName() string {
+	if hub.Name != "" {
+		return hub.Name
+	}
+	return hub.URL
+}
+
+// HubDevice is a device as listed by the Maker API.
+type HubDevice struct {
+	ID           int
+	Name         string
+	Label        string
+	Type         string
+	Capabilities []string
+	Commands     []string
+}
+
+// makerDevice is the Maker API's JSON for a device. IDs are strings, and
+// capabilities and commands mix plain names with objects depending on the endpoint
+// and firmware, so they are decoded loosely.
+type makerDevice struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Label        string            `json:"label"`
+	Type         string            `json:"type"`
+	Capabilities []json.RawMessage `json:"capabilities"`
+	Commands     []json.RawMessage `json:"commands"`
+}
+
+// names picks the plain names out of a mixed list, taking the given field from objects.
+func names(raw []json.RawMessage, field string) []string {
+	var list []string
+	for _, item := range raw {
+		var name string
+		if json.Unmarshal(item, &name) == nil {
+			list = append(list, name)
+			continue
+		}
+		var object map[string]interface{}
+		if json.Unmarshal(item, &object) == nil {
+			if name, ok := object[field].(string); ok {
+				list = append(list, name)
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// FetchDevices lists every device the Maker API instance exposes, from /devices/all.
+func (hub HubConfig) FetchDevices() ([]HubDevice, error) {
+	token := os.Getenv(AccessTokenVar(hub.APIID))
+	if token == "" {
+		return nil, fmt.Errorf("no access token for hub %v, set %v", hub.APIID, AccessTokenVar(hub.APIID))
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(hub.URL, "/")+"/devices/all?access_token="+url.QueryEscape(token), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient(defaultRequestTimeout).Do(req)
+	if err != nil {
+		// The error repeats the URL, which holds the token
+		return nil, fmt.Errorf("hub %v not reachable: %v", hub.APIID, strings.ReplaceAll(err.Error(), url.QueryEscape(token), "<access_token>"))
+	}
+	defer res.Body.Close()
+	err = checkResponse(res)
+	if err != nil {
+		return nil, fmt.Errorf("hub %v: %w", hub.APIID, err)
+	}
+
+	var listed []makerDevice
+	err = json.NewDecoder(res.Body).Decode(&listed)
+	if err != nil {
+		return nil, fmt.Errorf("hub %v returned an unexpected device list: %w", hub.APIID, err)
+	}
+	devices := make([]HubDevice, 0, len(listed))
+	for _, device := range listed {
+		id, err := strconv.Atoi(device.ID)
+		if err != nil {
+			return nil, fmt.Errorf("hub %v listed a device with id %q", hub.APIID, device.ID)
+		}
+		devices = append(devices, HubDevice{
+			ID:           id,
+			Name:         device.Name,
+			Label:        device.Label,
+			Type:         device.Type,
+			Capabilities: names(device.Capabilities, "name"),
+			Commands:     names(device.Commands, "command"),
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, nil
+}
+
+// ImportDevice returns the config entry for a device found on the hub. A device
+// already imported from this hub keeps its settings and only has the hub's details
+// refreshed. A device ID already used by a device from another hub, or one that
+// was added by hand, is an error. New device URLs are built from the hub's URL as
+// given, so pass the hub as written in the config file to keep its ${...}
+// references, rather than what they resolve to, in the saved URL.
+func (hub HubConfig) ImportDevice(device HubDevice, existing HubitatDeviceInfo, exists bool) (HubitatDeviceInfo, error) {
+	if exists && (existing.APIID != hub.APIID || existing.DeviceType() != DeviceTypeMaker) {
+		return HubitatDeviceInfo{}, fmt.Errorf("device %v is already configured for another hub or device type", device.ID)
+	}
+	entry := existing
+	if !exists {
+		deviceURL := fmt.Sprintf("%s/devices/%d/<action>?access_token=<access_token>", strings.TrimSuffix(hub.URL, "/"), device.ID)
+		entry = HubitatDeviceInfo{
+			DeviceID:  device.ID,
+			APIID:     hub.APIID,
+			DeviceURL: &deviceURL,
+		}
+	}
+	entry.Label = device.Label
+	if entry.Label == "" {
+		entry.Label = device.Name
+	}
+	entry.HubitatType = device.Type
+	entry.Capabilities = device.Capabilities
+	entry.Commands = device.Commands
+	return entry, nil
+}
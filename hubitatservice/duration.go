@@ -0,0 +1,57 @@
+package hubitatservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration for config files. It is written as a Go duration
+// string such as "90s" or "5m", and read from either a duration string or a bare
+// number, which always means whole seconds.
+type Duration time.Duration
+
+// ParseDuration reads a Go duration string, or a bare number as seconds.
+func ParseDuration(s string) (Duration, error) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return Duration(d), nil
+}
+
+// Duration returns the value as a time.Duration.
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	text := string(b)
+	if text == "null" {
+		*d = 0
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+	parsed, err := ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s: %w", b, err)
+	}
+	*d = parsed
+	return nil
+}
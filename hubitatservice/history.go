@@ -0,0 +1,89 @@
+package hubitatservice
+
+import (
+	"sync"
+	"time"
+)
+
+// ActionResult is the outcome of one attempt to run an action on a device.
+type ActionResult struct {
+	Time            time.Time
+	Rule            string
+	DeviceID        int
+	DeviceType      string
+	PrimaryAction   string
+	SecondaryAction string
+	// Status is the HTTP status of the call, 0 when no response was received or the
+	// device type does not use HTTP.
+	Status  int
+	Latency Duration
+	Error   string
+	// Attempt is 1 for the first call and counts up through the retries.
+	Attempt int
+	Trigger TriggerEvent
+}
+
+// Succeeded reports whether the call worked.
+func (r ActionResult) Succeeded() bool {
+	return r.Error == ""
+}
+
+// ResultHistory keeps the most recent action results so they can be shown in the UI.
+type ResultHistory struct {
+	mutex   sync.Mutex
+	size    int
+	records []ActionResult
+}
+
+// NewResultHistory creates a history holding at most size results.
+func NewResultHistory(size int) *ResultHistory {
+	return &ResultHistory{size: size}
+}
+
+// Add records a result, discarding the oldest one when full.
+func (rh *ResultHistory) Add(result ActionResult) {
+	if rh == nil {
+		return
+	}
+	rh.mutex.Lock()
+	defer rh.mutex.Unlock()
+	rh.records = append(rh.records, result)
+	if len(rh.records) > rh.size {
+		rh.records = rh.records[len(rh.records)-rh.size:]
+	}
+}
+
+// ResultFilter narrows a history listing. Zero values match everything.
+type ResultFilter struct {
+	DeviceID   *int
+	Rule       string
+	FailedOnly bool
+	Limit      int
+}
+
+// List returns the results matching the filter, newest first.
+func (rh *ResultHistory) List(filter ResultFilter) []ActionResult {
+	if rh == nil {
+		return nil
+	}
+	rh.mutex.Lock()
+	defer rh.mutex.Unlock()
+	records := make([]ActionResult, 0, len(rh.records))
+	for i := len(rh.records) - 1; i >= 0; i-- {
+		record := rh.records[i]
+		if filter.DeviceID != nil && record.DeviceID != *filter.DeviceID {
+			continue
+		}
+		if filter.Rule != "" && record.Rule != filter.Rule {
+			continue
+		}
+		if filter.FailedOnly && record.Succeeded() {
+			continue
+		}
+		records = append(records, record)
+		if filter.Limit > 0 && len(records) == filter.Limit {
+			break
+		}
+	}
+	return records
+}
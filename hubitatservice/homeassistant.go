@@ -0,0 +1,82 @@
+package hubitatservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DeviceTypeHomeAssistant calls a Home Assistant service through its REST API.
+const DeviceTypeHomeAssistant = "homeassistant"
+
+// homeAssistantActuator calls /api/services/<domain>/<service> on the Home Assistant
+// instance at the device's DeviceURL. The primaryAction names the service, either as
+// "domain.service" or as a service in the domain of the device's EntityID, e.g.
+// "turn_on" for light.porch. PostBody is the service data; EntityID is added to it
+// as entity_id unless the body sets one.
+type homeAssistantActuator struct{}
+
+func (homeAssistantActuator) Actuate(device HubitatDeviceInfo, command Command) (int, error) {
+	entityID := fillActions(renderTemplate(device.EntityID, command.Trigger), command)
+	domain, service, ok := strings.Cut(command.PrimaryAction, ".")
+	if !ok {
+		service = command.PrimaryAction
+		domain, _, ok = strings.Cut(entityID, ".")
+		if !ok {
+			return 0, fmt.Errorf("service %q has no domain and device %v has no EntityID to take one from", command.PrimaryAction, device.DeviceID)
+		}
+	}
+
+	data := make(map[string]interface{})
+	if device.PostBody != nil && *device.PostBody != "" {
+		body := fillActions(renderTemplate(*device.PostBody, command.Trigger), command)
+		err := json.Unmarshal([]byte(body), &data)
+		if err != nil {
+			return 0, fmt.Errorf("service data for device %v is not a JSON object: %w", device.DeviceID, err)
+		}
+	}
+	if _, ok := data["entity_id"]; !ok && entityID != "" {
+		data["entity_id"] = entityID
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+
+	serviceURL := strings.TrimSuffix(*device.DeviceURL, "/") + "/api/services/" + url.PathEscape(domain) + "/" + url.PathEscape(service)
+	req, err := http.NewRequest("POST", serviceURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+device.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	// Unlike hubs, Home Assistant gets a bearer token, so its certificate is verified
+	client := &http.Client{Timeout: device.Timeout()}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	err = checkResponse(res)
+	if err != nil {
+		return res.StatusCode, fmt.Errorf("home assistant %s.%s: %w", domain, service, err)
+	}
+	return res.StatusCode, nil
+}
+
+func (homeAssistantActuator) Validate(device HubitatDeviceInfo) map[string]string {
+	problems := make(map[string]string)
+	if device.DeviceURL == nil || *device.DeviceURL == "" {
+		problems["DeviceURL"] = "is required, the base URL of Home Assistant"
+	} else if u, err := url.Parse(*device.DeviceURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		problems["DeviceURL"] = "must be an http or https URL"
+	}
+	if device.Token == "" {
+		problems["Token"] = "is required for a homeassistant device"
+	}
+	return problems
+}
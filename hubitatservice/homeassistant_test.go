@@ -0,0 +1,130 @@
+package hubitatservice
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// haRequest is what the stand-in Home Assistant received.
+type haRequest struct {
+	path          string
+	authorization string
+	body          map[string]interface{}
+}
+
+// homeAssistantServer starts a stand-in Home Assistant that records each request
+// and answers with status.
+func homeAssistantServer(t *testing.T, status int) (*httptest.Server, *[]haRequest) {
+	t.Helper()
+	var requests []haRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		request := haRequest{path: r.URL.Path, authorization: r.Header.Get("Authorization")}
+		if err := json.Unmarshal(data, &request.body); err != nil {
+			t.Errorf("body is not a JSON object: %s", data)
+		}
+		requests = append(requests, request)
+		w.WriteHeader(status)
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func homeAssistantDevice(url string, entityID string, postBody string) HubitatDeviceInfo {
+	device := HubitatDeviceInfo{
+		DeviceID:  600,
+		Type:      DeviceTypeHomeAssistant,
+		DeviceURL: &url,
+		Token:     "secret-token",
+		EntityID:  entityID,
+	}
+	if postBody != "" {
+		device.PostBody = &postBody
+	}
+	return device
+}
+
+func TestHomeAssistantCallsService(t *testing.T) {
+	server, requests := homeAssistantServer(t, http.StatusOK)
+	device := homeAssistantDevice(server.URL+"/", "light.porch", `{"brightness_pct": <action2>}`)
+
+	status, err := homeAssistantActuator{}.Actuate(device, Command{PrimaryAction: "turn_on", SecondaryAction: "80"})
+	if err != nil {
+		t.Fatalf("Actuate: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("status = %d, want %d", status, http.StatusOK)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(*requests))
+	}
+	request := (*requests)[0]
+	if request.path != "/api/services/light/turn_on" {
+		t.Errorf("path = %q, want /api/services/light/turn_on", request.path)
+	}
+	if request.authorization != "Bearer secret-token" {
+		t.Errorf("Authorization = %q, want Bearer secret-token", request.authorization)
+	}
+	if request.body["entity_id"] != "light.porch" {
+		t.Errorf("entity_id = %v, want light.porch", request.body["entity_id"])
+	}
+	if request.body["brightness_pct"] != float64(80) {
+		t.Errorf("brightness_pct = %v, want 80", request.body["brightness_pct"])
+	}
+}
+
+func TestHomeAssistantServiceWithDomain(t *testing.T) {
+	server, requests := homeAssistantServer(t, http.StatusOK)
+	device := homeAssistantDevice(server.URL, "light.porch", "")
+
+	_, err := homeAssistantActuator{}.Actuate(device, Command{PrimaryAction: "switch.turn_off"})
+	if err != nil {
+		t.Fatalf("Actuate: %v", err)
+	}
+	if path := (*requests)[0].path; path != "/api/services/switch/turn_off" {
+		t.Errorf("path = %q, want /api/services/switch/turn_off", path)
+	}
+}
+
+func TestHomeAssistantBodyEntityWins(t *testing.T) {
+	server, requests := homeAssistantServer(t, http.StatusOK)
+	device := homeAssistantDevice(server.URL, "light.porch", `{"entity_id": "light.garden"}`)
+
+	_, err := homeAssistantActuator{}.Actuate(device, Command{PrimaryAction: "turn_on"})
+	if err != nil {
+		t.Fatalf("Actuate: %v", err)
+	}
+	if entityID := (*requests)[0].body["entity_id"]; entityID != "light.garden" {
+		t.Errorf("entity_id = %v, want the body's light.garden", entityID)
+	}
+}
+
+func TestHomeAssistantErrorStatus(t *testing.T) {
+	server, _ := homeAssistantServer(t, http.StatusUnauthorized)
+	device := homeAssistantDevice(server.URL, "light.porch", "")
+
+	status, err := homeAssistantActuator{}.Actuate(device, Command{PrimaryAction: "turn_on"})
+	if err == nil {
+		t.Fatal("Actuate succeeded on a 401")
+	}
+	if status != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestHomeAssistantNoDomain(t *testing.T) {
+	server, requests := homeAssistantServer(t, http.StatusOK)
+	device := homeAssistantDevice(server.URL, "", "")
+
+	_, err := homeAssistantActuator{}.Actuate(device, Command{PrimaryAction: "turn_on"})
+	if err == nil {
+		t.Fatal("Actuate succeeded without a domain")
+	}
+	if len(*requests) != 0 {
+		t.Errorf("got %d requests, want none", len(*requests))
+	}
+}
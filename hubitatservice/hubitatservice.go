@@ -16,28 +16,38 @@ import (
 )
 
 func (hs HubitatService) Start() {
-	// create the map we use later
-
+	hs.restoreState()
 	for {
 		hs.checkListAndSend()
+		hs.saveState()
 
-		// check channel for a few seconds
+		// Wait for new actions or updates, or until the next pending action is due
 		select {
 		case actionList := <-*hs.HubitatChannel:
 			// Add actions to queue
+			now := hs.Scheduler.Now()
 			deviceIds := make(map[int]bool)
 			log.Trace().Msgf("Got Actions: \n%v\n", actionList)
 
 			for _, action := range actionList {
 				log.Debug().Msgf("Filtering Action: %v", action)
-				inBackoff := hs.DeviceBackoffEnabled && hs.DeviceBackoff[action.DeviceId].After(time.Now()) && action.PrimaryAction != "off"
+				if hs.skipped(action, now) {
+					continue
+				}
+				if action.PrimaryAction == ActionCancel {
+					hs.cancelPending(action)
+					continue
+				}
+				if action.Manual && action.PrimaryAction == ActionOverride {
+					hs.startOverride(action.DeviceId, action.Rule)
+					continue
+				}
+				inBackoff := hs.DeviceBackoffEnabled && hs.DeviceBackoff[action.DeviceId].After(now) && action.PrimaryAction != "off" && !action.Manual
 				if !inBackoff {
-					action.CurrentDelay = time.Now().Add(action.StartDelay)
-					log.Info().Msg(fmt.Sprintf("Adding: %v", action))
-					combinedKey := strconv.Itoa(action.DeviceId) + action.PrimaryAction + action.SecondaryAction
-					hash := sha1.Sum([]byte(combinedKey))
-					keyHash := hex.EncodeToString(hash[:])
-					hs.AutomaticAction[keyHash] = action
+					if !hs.resolveConflicts(action) {
+						continue
+					}
+					hs.queueAction(action)
 					deviceIds[action.DeviceId] = true
 				} else {
 					// Make this an allow list later, but for now, filter on "off"
@@ -49,8 +59,11 @@ func (hs HubitatService) Start() {
 			// for any of the devices
 			if hs.DeviceBackoffEnabled { // Add/update backoff
 				for _, action := range actionList {
-					if hs.DeviceBackoff[action.DeviceId].Before(time.Now()) { // expired, add new backoff
-						hs.DeviceBackoff[action.DeviceId] = time.Now().Add(action.BackoffDelay)
+					if action.PrimaryAction == ActionCancel || (action.Manual && action.PrimaryAction == ActionOverride) || hs.skipped(action, now) {
+						continue
+					}
+					if hs.DeviceBackoff[action.DeviceId].Before(now) { // expired, add new backoff
+						hs.DeviceBackoff[action.DeviceId] = now.Add(action.BackoffDelay)
 					} else { // already active, extend
 						hs.DeviceBackoff[action.DeviceId] = hs.DeviceBackoff[action.DeviceId].Add(action.BackoffDelay)
 					}
@@ -59,86 +72,382 @@ func (hs HubitatService) Start() {
 		case update := <-*hs.UpdateChannel:
 			log.Debug().Msgf("Received update: %v", update)
 			hs.HubitatDeviceList[update.DeviceID] = update
-		case <-time.After(time.Duration(hs.Timeout) * time.Second):
+		case config := <-*hs.ConfigChannel:
+			hs.reconfigure(config)
+		case outcome := <-hs.Calls.done:
+			hs.finishCall(outcome)
+		case <-hs.Scheduler.Wake():
 			continue
 		}
 	}
 
 }
 
-// checkListAndSend is our polling interface for our schedule list.
+// reconfigure applies a reloaded HubitatConfig. The device list is replaced in place,
+// as it is shared, and pending actions for devices that no longer exist are dropped.
+func (hs *HubitatService) reconfigure(config HubitatServiceConfig) {
+	log.Info().Msgf("Applying reloaded config: %v devices", len(config.HubitatDevices))
+	for id := range hs.HubitatDeviceList {
+		if _, ok := config.HubitatDevices[id]; !ok {
+			delete(hs.HubitatDeviceList, id)
+		}
+	}
+	for id, device := range config.HubitatDevices {
+		hs.HubitatDeviceList[id] = device
+	}
+	for keyHash, action := range hs.AutomaticAction {
+		if _, ok := hs.HubitatDeviceList[action.DeviceId]; !ok {
+			log.Warn().Msgf("Dropping pending action for removed device %v: %v", action.DeviceId, action.PrimaryAction)
+			hs.removePending(keyHash)
+		}
+	}
+
+	hs.Timeout = config.Timeout.Duration()
+	hs.DeviceBackoffEnabled = config.DeviceBackoffEnabled
+	hs.ManualOverride = config.ManualOverride.Duration()
+	hs.Breaker.Configure(config.CircuitBreakerThreshold, config.CircuitBreakerCooldown.Duration())
+}
+
+// skipped reports whether an action is held back by its rule being snoozed or by
+// its when condition not being met.
+func (hs HubitatService) skipped(action ActionType, now time.Time) bool {
+	if action.SnoozeUntil.After(now) {
+		log.Debug().Msgf("Rule %v snoozed until %v", action.Rule, action.SnoozeUntil)
+		return true
+	}
+	if action.When != nil && !action.When.Met(hs.States) {
+		log.Debug().Msgf("Rule %v skipped, %v is not met", action.Rule, action.When)
+		return true
+	}
+	return false
+}
+
+// pendingKey identifies a pending action by its device and commands.
+func pendingKey(action ActionType) string {
+	combinedKey := strconv.Itoa(action.DeviceId) + action.PrimaryAction + action.SecondaryAction
+	hash := sha1.Sum([]byte(combinedKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// setPending stores a pending action and schedules it for its CurrentDelay.
+func (hs HubitatService) setPending(keyHash string, action ActionType) {
+	hs.AutomaticAction[keyHash] = action
+	hs.Scheduler.Schedule(keyHash, action.CurrentDelay)
+}
+
+// removePending drops a pending action and its place in the schedule.
+func (hs HubitatService) removePending(keyHash string) {
+	delete(hs.AutomaticAction, keyHash)
+	hs.Scheduler.Cancel(keyHash)
+}
+
+// resolveConflicts settles a new action against the device's manual override and the
+// other rules' pending actions. It reports whether the new action should be queued;
+// every action that loses is logged and recorded in the conflict log.
+func (hs HubitatService) resolveConflicts(action ActionType) bool {
+	now := hs.Scheduler.Now()
+	if action.Manual {
+		hs.startOverride(action.DeviceId, action.Rule)
+		return true
+	}
+
+	// Rules reacting to the device's own events, such as turning a light off a while
+	// after it was switched on by hand, are what the user set up for it and still run
+	ownEvent := action.Trigger.Attribute != "" && action.Trigger.DeviceID == action.DeviceId
+	if until := hs.ManualOverrideUntil[action.DeviceId]; until.After(now) && !ownEvent {
+		hs.recordConflict(action, fmt.Sprintf("manual override until %v", until.Format(time.Kitchen)))
+		return false
+	}
+
+	for keyHash, pending := range hs.AutomaticAction {
+		if pending.DeviceId != action.DeviceId || pending.Rule == action.Rule || pending.Manual {
+			continue
+		}
+		if action.Conflict != ConflictPriority && pending.Conflict != ConflictPriority {
+			continue
+		}
+		if pending.Priority > action.Priority {
+			hs.recordConflict(action, fmt.Sprintf("lower priority than pending %v from %v", pending.PrimaryAction, pending.Rule))
+			return false
+		}
+		if pending.Priority < action.Priority {
+			hs.dropAction(keyHash, pending, fmt.Sprintf("lower priority than %v from %v", action.PrimaryAction, action.Rule))
+		}
+	}
+	return true
+}
+
+// startOverride blocks automatic actions on a device for ManualOverride and drops
+// those already pending. source names the manual change, for the log.
+func (hs HubitatService) startOverride(deviceID int, source string) {
+	if hs.ManualOverride <= 0 {
+		return
+	}
+	hs.ManualOverrideUntil[deviceID] = hs.Scheduler.Now().Add(hs.ManualOverride)
+	log.Info().Msgf("Manual override of device %v by %v until %v", deviceID, source, hs.ManualOverrideUntil[deviceID].Format(time.Kitchen))
+	for keyHash, pending := range hs.AutomaticAction {
+		if pending.DeviceId == deviceID && !pending.Manual {
+			hs.dropAction(keyHash, pending, "manual override")
+		}
+	}
+}
+
+// dropAction removes a pending action that lost a conflict.
+func (hs HubitatService) dropAction(keyHash string, action ActionType, reason string) {
+	hs.removePending(keyHash)
+	hs.recordConflict(action, reason)
+}
+
+func (hs HubitatService) recordConflict(action ActionType, reason string) {
+	log.Info().Msgf("Conflict, dropping %v -> %v:%v (rule %v): %v", action.DeviceId, action.PrimaryAction, action.SecondaryAction, action.Rule, reason)
+	hs.Conflicts.Add(action, reason)
+}
+
+// queueAction schedules an action, applying its retrigger policy when the same
+// action is already waiting for this device.
+func (hs HubitatService) queueAction(action ActionType) {
+	keyHash := pendingKey(action)
+	pending, isPending := hs.AutomaticAction[keyHash]
+	if !isPending {
+		action.CurrentDelay = hs.Scheduler.Now().Add(action.StartDelay)
+		log.Info().Msg(fmt.Sprintf("Adding: %v", action))
+		hs.setPending(keyHash, action)
+		return
+	}
+
+	switch action.Retrigger {
+	case RetriggerIgnore:
+		log.Debug().Msgf("Retrigger ignored, keeping: %v", pending)
+	case RetriggerCancel:
+		log.Info().Msgf("Retrigger cancelled: %v", pending)
+		hs.removePending(keyHash)
+	case RetriggerExtend:
+		// Each trigger adds another delay to the pending deadline, up to
+		// maxExtendDelays delays from now; a deadline already past that is kept
+		action.CurrentDelay = pending.CurrentDelay.Add(action.StartDelay)
+		limit := hs.Scheduler.Now().Add(maxExtendDelays * action.StartDelay)
+		if action.CurrentDelay.After(limit) {
+			action.CurrentDelay = limit
+			if pending.CurrentDelay.After(limit) {
+				action.CurrentDelay = pending.CurrentDelay
+			}
+		}
+		log.Info().Msgf("Retrigger extended until %v: %v", action.CurrentDelay, action)
+		hs.setPending(keyHash, action)
+	default:
+		action.CurrentDelay = hs.Scheduler.Now().Add(action.StartDelay)
+		log.Info().Msgf("Retrigger restarted until %v: %v", action.CurrentDelay, action)
+		hs.setPending(keyHash, action)
+	}
+}
+
+// cancelPending removes the pending actions addressed by a cancel action.
+func (hs HubitatService) cancelPending(cancel ActionType) {
+	rule, byRule := strings.CutPrefix(cancel.SecondaryAction, RulePrefix)
+	for keyHash, pending := range hs.AutomaticAction {
+		if pending.DeviceId != cancel.DeviceId {
+			continue
+		}
+		if byRule && pending.Rule != rule {
+			continue
+		}
+		if !byRule && cancel.SecondaryAction != "" && pending.PrimaryAction != cancel.SecondaryAction {
+			continue
+		}
+		log.Info().Msgf("Cancelled by %v: %v", cancel.Rule, pending)
+		hs.removePending(keyHash)
+	}
+}
+
+// checkListAndSend starts the call for every pending action that is due, in the order
+// they came due. Calls run outside the service loop and finishCall handles their
+// outcome; an action whose device is still busy with a call waits for it.
 func (hs HubitatService) checkListAndSend() {
-	for combinedKey, actionInfo := range hs.AutomaticAction {
-		if actionInfo.CurrentDelay.Before(time.Now()) {
-			if actionInfo.DeviceId == 0 {
-				callPostAction(*hs.HubitatDeviceList[actionInfo.DeviceId].DeviceURL, *hs.HubitatDeviceList[actionInfo.DeviceId].PostBody, actionInfo.PrimaryAction, actionInfo.SecondaryAction, true)
-			} else {
-				log.Debug().Msg(fmt.Sprintf("Running Action: %v -> %v:%v", actionInfo.DeviceId, actionInfo.PrimaryAction, actionInfo.SecondaryAction))
-				callAction(*hs.HubitatDeviceList[actionInfo.DeviceId].DeviceURL, actionInfo.PrimaryAction, actionInfo.SecondaryAction)
+	now := hs.Scheduler.Now()
+	for _, combinedKey := range hs.Scheduler.PopDue(now) {
+		actionInfo, ok := hs.AutomaticAction[combinedKey]
+		if !ok {
+			continue
+		}
+		device, ok := hs.HubitatDeviceList[actionInfo.DeviceId]
+		if !ok {
+			log.Error().Msgf("Device %v not found, dropping action: %v", actionInfo.DeviceId, actionInfo.PrimaryAction)
+			hs.removePending(combinedKey)
+			continue
+		}
+		if hs.Calls.busy(actionInfo.DeviceId) {
+			log.Debug().Msgf("Device %v busy, action waiting: %v", actionInfo.DeviceId, actionInfo.PrimaryAction)
+			hs.Calls.wait(actionInfo.DeviceId, combinedKey)
+			continue
+		}
+
+		// While the device's hub is unhealthy the action waits for it without using up a retry
+		hub := device.hub()
+		if allowed, retryAt := hs.Breaker.Allow(hub, now); !allowed {
+			log.Debug().Msgf("Hub %v unhealthy, holding action for device %v until %v", hub, actionInfo.DeviceId, retryAt)
+			actionInfo.CurrentDelay = retryAt
+			hs.setPending(combinedKey, actionInfo)
+			continue
+		}
+
+		if device.RequestTimeout == 0 {
+			device.RequestTimeout = Duration(hs.Timeout)
+		}
+
+		// Fill any {{...}} placeholders from the event that triggered the action
+		trigger := actionInfo.Trigger
+		command := Command{
+			PrimaryAction:      renderTemplate(actionInfo.PrimaryAction, trigger),
+			SecondaryAction:    renderTemplate(actionInfo.SecondaryAction, trigger),
+			URLPrimaryAction:   renderURLTemplate(actionInfo.PrimaryAction, trigger),
+			URLSecondaryAction: renderURLTemplate(actionInfo.SecondaryAction, trigger),
+			Trigger:            trigger,
+		}
+		log.Debug().Msg(fmt.Sprintf("Running Action: %v (%v) -> %v:%v", actionInfo.DeviceId, device.DeviceType(), command.PrimaryAction, command.SecondaryAction))
+
+		// The action leaves the queue while it runs, so the same action triggered again
+		// in the meantime is queued afresh rather than lost when this call finishes
+		hs.removePending(combinedKey)
+		action := actionInfo
+		hs.Calls.start(action, func() callOutcome {
+			started := time.Now()
+			status, err := actuate(device, command)
+			result := ActionResult{
+				Time:            started,
+				Rule:            action.Rule,
+				DeviceID:        action.DeviceId,
+				DeviceType:      device.DeviceType(),
+				PrimaryAction:   command.PrimaryAction,
+				SecondaryAction: command.SecondaryAction,
+				Status:          status,
+				Latency:         Duration(time.Since(started).Round(time.Microsecond)),
+				Attempt:         action.Attempts + 1,
+				Trigger:         trigger,
+			}
+			if err != nil {
+				result.Error = err.Error()
 			}
-			delete(hs.AutomaticAction, combinedKey)
+			return callOutcome{action: action, device: device, result: result, err: err}
+		})
+	}
+}
+
+// finishCall records the outcome of a device call and schedules a retry when it
+// failed. Actions that waited for the device are due again straight away.
+func (hs HubitatService) finishCall(outcome callOutcome) {
+	now := hs.Scheduler.Now()
+	actionInfo, device, err := outcome.action, outcome.device, outcome.err
+	for _, keyHash := range hs.Calls.finish(actionInfo.DeviceId) {
+		if waiting, ok := hs.AutomaticAction[keyHash]; ok {
+			hs.Scheduler.Schedule(keyHash, waiting.CurrentDelay)
 		}
 	}
+
+	hs.Results.Add(outcome.result)
+	hub := device.hub()
+	if err == nil {
+		hs.Breaker.Success(hub)
+		return
+	}
+
+	if hs.Breaker.Failure(hub, err, now) {
+		log.Error().Msgf("Hub %v marked unhealthy after repeated failures: %v", hub, err)
+	}
+	actionInfo.Attempts++
+	if actionInfo.Attempts > device.RetryLimit() {
+		log.Error().Msgf("Action failed on device %v after %d attempts, giving up: %v", actionInfo.DeviceId, actionInfo.Attempts, err)
+		hs.Failures.Add(actionInfo, err)
+		return
+	}
+	combinedKey := pendingKey(actionInfo)
+	if _, ok := hs.AutomaticAction[combinedKey]; ok {
+		log.Warn().Msgf("Action failed on device %v, not retrying as it has been queued again: %v", actionInfo.DeviceId, err)
+		return
+	}
+	actionInfo.CurrentDelay = now.Add(device.retryDelay(actionInfo.Attempts))
+	log.Warn().Msgf("Action failed on device %v, attempt %d, retrying at %v: %v", actionInfo.DeviceId, actionInfo.Attempts, actionInfo.CurrentDelay.Format(time.TimeOnly), err)
+	hs.setPending(combinedKey, actionInfo)
 }
 
-// callAction hits the hubitat MakerAPI and, for now updates a single action (on or off)
-func callAction(url string, action string, secondaryAction string) error {
-	url = strings.Replace(url, "<action>", action, 1)
-	url = strings.Replace(url, "<action2>", secondaryAction, 1)
-	client := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+// insecureTransport is shared by every device call so connections to a hub are reused.
+// Hubs commonly use self-signed certificates, so they are not verified.
+var insecureTransport = &http.Transport{
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+}
+
+// httpClient returns a client for a single device call with the given timeout.
+func httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: insecureTransport, Timeout: timeout}
+}
+
+// checkResponse turns an error status into an error, with the start of the body.
+func checkResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return nil
 	}
+	resBody, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(resBody)))
+}
+
+// callAction hits the hubitat MakerAPI and, for now updates a single action (on or off).
+// The actions are filled in as given, already rendered with renderURLTemplate.
+func callAction(deviceURL string, action string, secondaryAction string, timeout time.Duration) (int, error) {
+	deviceURL = strings.Replace(deviceURL, "<action>", action, 1)
+	deviceURL = strings.Replace(deviceURL, "<action2>", secondaryAction, 1)
 
-	res, err := client.Get(url)
+	res, err := httpClient(timeout).Get(deviceURL)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer res.Body.Close()
+	err = checkResponse(res)
+	if err != nil {
+		return res.StatusCode, err
 	}
 
 	if log.Logger.GetLevel() == zerolog.TraceLevel {
 		resBody, err := io.ReadAll(res.Body)
 		if err != nil {
-			return err
+			return res.StatusCode, err
 		}
 
 		fmt.Printf("client: response body: %s\n", resBody)
 	}
 
-	return nil
+	return res.StatusCode, nil
 }
 
-// callPostAction hits other places
-func callPostAction(url string, postBody string, action string, secondaryAction string, print bool) error {
-	url = strings.Replace(url, "<action>", action, 1)
+// callPostAction hits other places. The action is filled into the URL as given,
+// already rendered with renderURLTemplate, and the secondaryAction into the body.
+func callPostAction(deviceURL string, postBody string, action string, secondaryAction string, timeout time.Duration, print bool) (int, error) {
+	deviceURL = strings.Replace(deviceURL, "<action>", action, 1)
 	postBody = strings.Replace(postBody, "<action2>", secondaryAction, 1)
-	client := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-	}
-	log.Debug().Msgf("Post URL: %v", url)
+	log.Debug().Msgf("Post URL: %v", deviceURL)
 	log.Debug().Msgf("Post Body: %v", postBody)
-	req, err := http.NewRequest("POST", url, strings.NewReader(postBody))
+	req, err := http.NewRequest("POST", deviceURL, strings.NewReader(postBody))
 	if err != nil {
-		return err
+		return 0, err
 	}
 	req.Header.Set("Content-Type", "application/json") // Set appropriate content type
 
-	res, err := client.Do(req)
+	res, err := httpClient(timeout).Do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer res.Body.Close()
+	err = checkResponse(res)
+	if err != nil {
+		return res.StatusCode, err
+	}
 
 	if print {
 		resBody, err := io.ReadAll(res.Body)
 		if err != nil {
-			return err
+			return res.StatusCode, err
 		}
 
 		fmt.Printf("client: response body: %s\n", resBody)
 	}
 
-	return nil
+	return res.StatusCode, nil
 }
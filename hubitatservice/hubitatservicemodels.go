@@ -4,44 +4,171 @@ import "time"
 
 type HubitatServiceConfig struct {
 	HubitatDevices       map[int]HubitatDeviceInfo `json:"HubitatDevices"`
-	TimeoutSeconds       int                       `json:"TimeoutSeconds"`
+	Timeout              Duration                  `json:"Timeout"`
 	DeviceBackoffEnabled bool                      `json:"DeviceBackoffEnabled"`
 	ActionsListLocation  string                    `json:"ActionsListLocation"`
+	Scenes               map[string]Scene          `json:"Scenes"`
+	ManualOverride       Duration                  `json:"ManualOverride"`
+	// Hubs are the Maker API instances devices can be imported from.
+	Hubs []HubConfig `json:"Hubs,omitempty"`
+	// CircuitBreakerThreshold failed calls in a row mark a hub unhealthy for
+	// CircuitBreakerCooldown. Zero uses the defaults, 5 and one minute.
+	CircuitBreakerThreshold int      `json:"CircuitBreakerThreshold,omitempty"`
+	CircuitBreakerCooldown  Duration `json:"CircuitBreakerCooldown,omitempty"`
+	// StateFile keeps pending actions and backoff deadlines across restarts. Saved
+	// actions that came due while stopped follow OverduePolicy, run or drop, and are
+	// dropped anyway once overdue by more than OverdueMaxAge, if set.
+	StateFile     string   `json:"StateFile,omitempty"`
+	OverduePolicy string   `json:"OverduePolicy,omitempty"`
+	OverdueMaxAge Duration `json:"OverdueMaxAge,omitempty"`
 }
 
 type HubitatDeviceInfo struct {
-	DeviceID      int     `json:"DeviceId"`
-	APIID         int     `json:"APIId"`
-	DeviceURL     *string `json:"DeviceURL"`
-	PostBody      *string `json:"PostBody"`
-	DeviceBackoff int     `json:"DeviceBackoff"`
+	DeviceID      int      `json:"DeviceId"`
+	APIID         int      `json:"APIId"`
+	DeviceURL     *string  `json:"DeviceURL"`
+	PostBody      *string  `json:"PostBody"`
+	DeviceBackoff Duration `json:"DeviceBackoff"`
+	// Type picks the actuator that runs the device's commands, see DeviceType.
+	Type string `json:"Type,omitempty"`
+	// Topic, QoS and Retain are used by mqtt devices.
+	Topic  string `json:"Topic,omitempty"`
+	QoS    byte   `json:"QoS,omitempty"`
+	Retain bool   `json:"Retain,omitempty"`
+	// EntityID and Token are used by homeassistant devices.
+	EntityID string `json:"EntityID,omitempty"`
+	Token    string `json:"Token,omitempty"`
+	// Retries, RetryBackoff and RequestTimeout control how failed calls are retried,
+	// see RetryLimit and Timeout for the defaults.
+	Retries        *int     `json:"Retries,omitempty"`
+	RetryBackoff   Duration `json:"RetryBackoff,omitempty"`
+	RequestTimeout Duration `json:"RequestTimeout,omitempty"`
+	// Label, HubitatType, Capabilities and Commands describe devices imported from a
+	// hub. They are for reference and are refreshed by each import.
+	Label        string   `json:"Label,omitempty"`
+	HubitatType  string   `json:"HubitatType,omitempty"`
+	Capabilities []string `json:"Capabilities,omitempty"`
+	Commands     []string `json:"Commands,omitempty"`
 }
 
+// Retrigger policies decide what happens when a rule fires again while its
+// action for the same device is still waiting on its delay.
+const (
+	RetriggerRestart = "restart" // start the delay again from now (the default)
+	RetriggerExtend  = "extend"  // add the delay to the pending deadline, up to maxExtendDelays delays from now
+	RetriggerIgnore  = "ignore"  // keep the pending action as it is
+	RetriggerCancel  = "cancel"  // drop the pending action without queuing a new one
+)
+
+// maxExtendDelays caps the extend policy: however often a rule fires, its pending
+// action is never due more than this many delays from the latest trigger.
+const maxExtendDelays = 4
+
+// ActionCancel is the primaryAction that removes pending actions for its device instead
+// of sending a command. The secondaryAction narrows what is cancelled: empty for
+// everything on the device, "rule:<rule>" for actions queued by one rule, or a
+// primaryAction such as "close".
+const ActionCancel = "cancel"
+
+// ActionOverride marks a manual action that only starts a manual override of its
+// device, for changes made outside SoftRains such as a switch flipped by hand. It
+// sends no command, and is ignored unless Manual is set.
+const ActionOverride = "override"
+
+// RulePrefix marks a cancel filter that addresses pending actions by rule.
+const RulePrefix = "rule:"
+
 type ActionType struct {
+	Rule            string
 	DeviceId        int
 	PrimaryAction   string
 	SecondaryAction string
 	StartDelay      time.Duration
 	BackoffDelay    time.Duration
 	CurrentDelay    time.Time
+	Retrigger       string
+	Priority        int
+	Conflict        string
+	Manual          bool
+	SnoozeUntil     time.Time
+	Trigger         TriggerEvent
+	// Attempts counts the failed calls made for the action so far.
+	Attempts int
+	// When, if set, must be met for the action to be queued.
+	When *StateCondition
 }
 
 type HubitatService struct {
-	AutomaticAction        map[string]ActionType
-	HubitatDeviceList      map[int]HubitatDeviceInfo
-	HubitatChannel         *chan []ActionType
-	UpdateChannel          *chan HubitatDeviceInfo
-	DeviceBackoff          map[int]time.Time
-	Timeout                int
+	AutomaticAction   map[string]ActionType
+	HubitatDeviceList map[int]HubitatDeviceInfo
+	HubitatChannel    *chan []ActionType
+	UpdateChannel     *chan HubitatDeviceInfo
+	ConfigChannel     *chan HubitatServiceConfig
+	DeviceBackoff     map[int]time.Time
+	// Timeout is the request timeout for devices that do not set RequestTimeout.
+	Timeout                time.Duration
 	DeviceBackoffEnabled   bool
 	DefaultBackoffInterval int
+	ManualOverride         time.Duration
+	ManualOverrideUntil    map[int]time.Time
+	Conflicts              *ConflictLog
+	Breaker                *CircuitBreaker
+	Failures               *FailureLog
+	Results                *ResultHistory
+	Scheduler              *Scheduler
+	Calls                  *DeviceCalls
+	State                  *StateStore
+	States                 *DeviceStates
+	OverduePolicy          string
+	OverdueMaxAge          time.Duration
+	// RuleActive reports whether a rule still exists and is enabled, so saved actions
+	// of rules removed while SoftRains was down are not run. Nil keeps them all.
+	RuleActive func(rule string) bool
 }
 
 type ActionInput struct {
-	DeviceID        int            `json:"deviceId"`
-	Delay           int            `json:"delay"`
-	PrimaryAction   string         `json:"primaryAction"`
-	SecondaryAction string         `json:"secondaryAction"`
-	CameraSource    string         `json:"cameraSource"`
-	Backoff         *time.Duration `json:"backoff"`
+	ID              string     `json:"id"`
+	DeviceID        int        `json:"deviceId"`
+	Delay           Duration   `json:"delay"`
+	PrimaryAction   string     `json:"primaryAction"`
+	SecondaryAction string     `json:"secondaryAction"`
+	CameraSource    string     `json:"cameraSource"`
+	Backoff         Duration   `json:"backoff"`
+	Scene           string     `json:"scene,omitempty"`
+	Retrigger       string     `json:"retrigger,omitempty"`
+	AbsentFor       Duration   `json:"absentFor,omitempty"`
+	Priority        int        `json:"priority,omitempty"`
+	Conflict        string     `json:"conflict,omitempty"`
+	Enabled         *bool      `json:"enabled,omitempty"`
+	SnoozeUntil     *time.Time `json:"snoozeUntil,omitempty"`
+	// When limits the rule to times a device attribute has a value, see StateCondition.
+	When string `json:"when,omitempty"`
+	// Source is the file the rule was read from, so it is saved back to the same file.
+	Source string `json:"-"`
+}
+
+// IsEnabled reports whether the rule is active. Rules without an enabled flag are.
+func (a ActionInput) IsEnabled() bool {
+	return a.Enabled == nil || *a.Enabled
+}
+
+// IsSnoozed reports whether the rule is snoozed at the given time.
+func (a ActionInput) IsSnoozed(now time.Time) bool {
+	return a.SnoozeUntil != nil && a.SnoozeUntil.After(now)
+}
+
+// Scene is a named group of device commands that can be run together,
+// either from a rule in the actions file or manually from the UI and MQTT.
+type Scene struct {
+	Name     string         `json:"Name"`
+	Commands []SceneCommand `json:"Commands"`
+}
+
+// SceneCommand is a single device change within a scene. Delay is measured
+// from the moment the scene is triggered.
+type SceneCommand struct {
+	DeviceID        int      `json:"deviceId"`
+	Delay           Duration `json:"delay"`
+	PrimaryAction   string   `json:"primaryAction"`
+	SecondaryAction string   `json:"secondaryAction"`
 }
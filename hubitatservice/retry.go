@@ -0,0 +1,262 @@
+package hubitatservice
+
+import (
+	"math/rand"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults for devices and hubs that do not set their own.
+const (
+	defaultRetries          = 3
+	defaultRetryBackoff     = 2 * time.Second
+	maxRetryBackoff         = 5 * time.Minute
+	defaultRequestTimeout   = 10 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = time.Minute
+)
+
+// RetryLimit is how many times a failed command is tried again before it is given up.
+func (d HubitatDeviceInfo) RetryLimit() int {
+	if d.Retries == nil {
+		return defaultRetries
+	}
+	return *d.Retries
+}
+
+// Timeout is how long a single request to the device may take. The service fills
+// in its own Timeout for devices without a RequestTimeout before calling them.
+func (d HubitatDeviceInfo) Timeout() time.Duration {
+	if d.RequestTimeout > 0 {
+		return d.RequestTimeout.Duration()
+	}
+	return defaultRequestTimeout
+}
+
+// retryDelay is the wait before the given retry: RetryBackoff doubled for every
+// earlier attempt, capped, with up to half of it added at random so devices on a
+// hub that came back do not all retry at once.
+func (d HubitatDeviceInfo) retryDelay(attempt int) time.Duration {
+	delay := defaultRetryBackoff
+	if d.RetryBackoff > 0 {
+		delay = d.RetryBackoff.Duration()
+	}
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// hub names what a device's circuit breaker tracks: the host of its URL, or the
+// broker for mqtt devices. Devices without one, such as log devices, are not tracked.
+func (d HubitatDeviceInfo) hub() string {
+	switch d.DeviceType() {
+	case DeviceTypeMQTT:
+		return "mqtt"
+	case DeviceTypeLog:
+		return ""
+	}
+	if d.DeviceURL == nil {
+		return ""
+	}
+	u, err := url.Parse(*d.DeviceURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// HubStatus is the health of one hub as seen by the circuit breaker.
+type HubStatus struct {
+	Hub       string
+	Healthy   bool
+	Failures  int
+	OpenUntil time.Time
+	LastError string
+}
+
+// CircuitBreaker marks a hub unhealthy after a run of failed calls and holds back
+// calls to it for a cooldown, after which one call is let through to test it.
+type CircuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	hubs      map[string]*HubStatus
+}
+
+// NewCircuitBreaker creates a breaker with the default threshold and cooldown.
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{threshold: defaultBreakerThreshold, cooldown: defaultBreakerCooldown, hubs: make(map[string]*HubStatus)}
+}
+
+// Configure sets the failures that open the breaker and how long it stays open.
+// Zero keeps the default.
+func (cb *CircuitBreaker) Configure(threshold int, cooldown time.Duration) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.threshold = defaultBreakerThreshold
+	if threshold > 0 {
+		cb.threshold = threshold
+	}
+	cb.cooldown = defaultBreakerCooldown
+	if cooldown > 0 {
+		cb.cooldown = cooldown
+	}
+}
+
+// Allow reports whether a call to the hub may be made now. When it may not, it
+// returns when the hub will next be tried.
+func (cb *CircuitBreaker) Allow(hub string, now time.Time) (bool, time.Time) {
+	if hub == "" {
+		return true, time.Time{}
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	status, ok := cb.hubs[hub]
+	if !ok || status.Healthy {
+		return true, time.Time{}
+	}
+	if now.Before(status.OpenUntil) {
+		return false, status.OpenUntil
+	}
+	// The cooldown is over: let this call through and hold the rest until it is known
+	status.OpenUntil = now.Add(cb.cooldown)
+	return true, time.Time{}
+}
+
+// Success records a call that worked and closes the hub's breaker.
+func (cb *CircuitBreaker) Success(hub string) {
+	if hub == "" {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.hubs[hub] = &HubStatus{Hub: hub, Healthy: true}
+}
+
+// Failure records a failed call. It reports whether this failure opened the breaker.
+func (cb *CircuitBreaker) Failure(hub string, err error, now time.Time) bool {
+	if hub == "" {
+		return false
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	status, ok := cb.hubs[hub]
+	if !ok {
+		status = &HubStatus{Hub: hub}
+		cb.hubs[hub] = status
+	}
+	status.Failures++
+	status.LastError = err.Error()
+	if status.Failures < cb.threshold {
+		status.Healthy = true
+		return false
+	}
+	// A failed test call after the cooldown opens the breaker again straight away
+	opened := status.Healthy || status.OpenUntil.IsZero()
+	status.Healthy = false
+	status.OpenUntil = now.Add(cb.cooldown)
+	return opened
+}
+
+// Status lists every hub that has been called, sorted by name.
+func (cb *CircuitBreaker) Status() []HubStatus {
+	if cb == nil {
+		return nil
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	hubs := make([]HubStatus, 0, len(cb.hubs))
+	for _, status := range cb.hubs {
+		hubs = append(hubs, *status)
+	}
+	sort.Slice(hubs, func(i, j int) bool { return hubs[i].Hub < hubs[j].Hub })
+	return hubs
+}
+
+// FailedAction is an action that was given up after its retries ran out.
+type FailedAction struct {
+	ID              int
+	Time            time.Time
+	DeviceID        int
+	Rule            string
+	PrimaryAction   string
+	SecondaryAction string
+	Attempts        int
+	Error           string
+	action          ActionType
+}
+
+// FailureLog keeps the most recent failed actions so they can be reported and retried.
+type FailureLog struct {
+	mutex   sync.Mutex
+	size    int
+	nextID  int
+	records []FailedAction
+}
+
+// NewFailureLog creates a log holding at most size failed actions.
+func NewFailureLog(size int) *FailureLog {
+	return &FailureLog{size: size}
+}
+
+// Add records a failed action, discarding the oldest record when full.
+func (fl *FailureLog) Add(action ActionType, err error) {
+	if fl == nil {
+		return
+	}
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+	fl.nextID++
+	fl.records = append(fl.records, FailedAction{
+		ID:              fl.nextID,
+		Time:            time.Now(),
+		DeviceID:        action.DeviceId,
+		Rule:            action.Rule,
+		PrimaryAction:   action.PrimaryAction,
+		SecondaryAction: action.SecondaryAction,
+		Attempts:        action.Attempts,
+		Error:           err.Error(),
+		action:          action,
+	})
+	if len(fl.records) > fl.size {
+		fl.records = fl.records[len(fl.records)-fl.size:]
+	}
+}
+
+// List returns the failed actions, newest first.
+func (fl *FailureLog) List() []FailedAction {
+	if fl == nil {
+		return nil
+	}
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+	records := make([]FailedAction, len(fl.records))
+	for i, record := range fl.records {
+		records[len(fl.records)-1-i] = record
+	}
+	return records
+}
+
+// Take removes a failed action from the log and returns it ready to be queued again.
+func (fl *FailureLog) Take(id int) (ActionType, bool) {
+	if fl == nil {
+		return ActionType{}, false
+	}
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+	for i, record := range fl.records {
+		if record.ID == id {
+			fl.records = append(fl.records[:i], fl.records[i+1:]...)
+			action := record.action
+			action.Attempts = 0
+			return action, true
+		}
+	}
+	return ActionType{}, false
+}
@@ -0,0 +1,165 @@
+package hubitatservice
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Clock is the source of time for the scheduler, so it can be replaced when
+// testing timing.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer fires once on C after the duration it was created with, unless stopped.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// scheduleEntry is one key in the scheduler's queue.
+type scheduleEntry struct {
+	key   string
+	due   time.Time
+	index int
+}
+
+// scheduleQueue is a min-heap of entries ordered by due time.
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	entry := x.(*scheduleEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	entry.index = -1
+	return entry
+}
+
+// Scheduler orders pending actions by the time they are due, so the service can
+// sleep until exactly the next one instead of polling. Keys are pendingKeys; the
+// actions themselves stay in AutomaticAction. It is only used from the service's
+// own goroutine and is not safe for concurrent use.
+type Scheduler struct {
+	clock   Clock
+	queue   scheduleQueue
+	entries map[string]*scheduleEntry
+	timer   Timer
+}
+
+// NewScheduler creates an empty scheduler using the given clock.
+func NewScheduler(clock Clock) *Scheduler {
+	return &Scheduler{clock: clock, entries: make(map[string]*scheduleEntry)}
+}
+
+// Now is the current time on the scheduler's clock.
+func (s *Scheduler) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Schedule sets when a key is due, adding it or moving it if already scheduled.
+func (s *Scheduler) Schedule(key string, due time.Time) {
+	if entry, ok := s.entries[key]; ok {
+		entry.due = due
+		heap.Fix(&s.queue, entry.index)
+		return
+	}
+	entry := &scheduleEntry{key: key, due: due}
+	heap.Push(&s.queue, entry)
+	s.entries[key] = entry
+}
+
+// Cancel removes a key. Cancelling a key that is not scheduled does nothing.
+func (s *Scheduler) Cancel(key string) {
+	entry, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&s.queue, entry.index)
+	delete(s.entries, key)
+}
+
+// Len is the number of scheduled keys.
+func (s *Scheduler) Len() int {
+	return len(s.queue)
+}
+
+// Next returns the earliest due time, or false when nothing is scheduled.
+func (s *Scheduler) Next() (time.Time, bool) {
+	if len(s.queue) == 0 {
+		return time.Time{}, false
+	}
+	return s.queue[0].due, true
+}
+
+// PopDue removes and returns every key due at or before now, earliest first.
+func (s *Scheduler) PopDue(now time.Time) []string {
+	var keys []string
+	for len(s.queue) > 0 && !s.queue[0].due.After(now) {
+		entry := heap.Pop(&s.queue).(*scheduleEntry)
+		delete(s.entries, entry.key)
+		keys = append(keys, entry.key)
+	}
+	return keys
+}
+
+// Wake returns a channel that fires when the earliest key is due, replacing the
+// timer from the previous call. It returns nil, which blocks forever in a select,
+// when nothing is scheduled.
+func (s *Scheduler) Wake() <-chan time.Time {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	due, ok := s.Next()
+	if !ok {
+		return nil
+	}
+	delay := due.Sub(s.clock.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	s.timer = s.clock.NewTimer(delay)
+	return s.timer.C()
+}
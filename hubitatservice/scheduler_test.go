@@ -0,0 +1,248 @@
+package hubitatservice
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to. Its timers fire on Advance.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	due     time.Time
+	delay   time.Duration
+	c       chan time.Time
+	stopped bool
+	fired   bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	timer := &fakeTimer{due: c.now.Add(d), delay: d, c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock on and fires every timer that has come due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	for _, timer := range c.timers {
+		if !timer.stopped && !timer.fired && !timer.due.After(c.now) {
+			timer.fired = true
+			timer.c <- c.now
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	active := !t.stopped && !t.fired
+	t.stopped = true
+	return active
+}
+
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSchedulerPopDueOrder(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+	now := clock.Now()
+	s.Schedule("late", now.Add(3*time.Minute))
+	s.Schedule("early", now.Add(time.Minute))
+	s.Schedule("middle", now.Add(2*time.Minute))
+	s.Schedule("later", now.Add(10*time.Minute))
+
+	if due := s.PopDue(now); len(due) != 0 {
+		t.Fatalf("PopDue before anything is due = %v, want none", due)
+	}
+	got := s.PopDue(now.Add(3 * time.Minute))
+	want := []string{"early", "middle", "late"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PopDue = %v, want %v", got, want)
+	}
+	if s.Len() != 1 {
+		t.Errorf("Len = %d, want 1", s.Len())
+	}
+	if next, ok := s.Next(); !ok || !next.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("Next = %v, %v, want %v", next, ok, now.Add(10*time.Minute))
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+	now := clock.Now()
+	s.Schedule("a", now.Add(time.Minute))
+	s.Schedule("b", now.Add(2*time.Minute))
+	s.Schedule("a", now.Add(3*time.Minute))
+
+	if s.Len() != 2 {
+		t.Fatalf("Len = %d, want 2 after rescheduling a key", s.Len())
+	}
+	got := s.PopDue(now.Add(5 * time.Minute))
+	want := []string{"b", "a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PopDue = %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+	now := clock.Now()
+	s.Schedule("a", now.Add(time.Minute))
+	s.Schedule("b", now.Add(2*time.Minute))
+	s.Schedule("c", now.Add(3*time.Minute))
+
+	s.Cancel("b")
+	s.Cancel("missing")
+	if s.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", s.Len())
+	}
+	got := s.PopDue(now.Add(5 * time.Minute))
+	want := []string{"a", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PopDue = %v, want %v", got, want)
+	}
+	if _, ok := s.Next(); ok {
+		t.Error("Next reports a key after everything was popped")
+	}
+}
+
+func TestSchedulerWakeEmpty(t *testing.T) {
+	s := NewScheduler(newFakeClock())
+	if c := s.Wake(); c != nil {
+		t.Error("Wake with nothing scheduled returned a channel")
+	}
+}
+
+func TestSchedulerWakeFiresWhenDue(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+	s.Schedule("a", clock.Now().Add(time.Minute))
+
+	wake := s.Wake()
+	clock.Advance(59 * time.Second)
+	if fired(wake) {
+		t.Fatal("Wake fired before the key was due")
+	}
+	clock.Advance(time.Second)
+	if !fired(wake) {
+		t.Fatal("Wake did not fire when the key came due")
+	}
+	if got := s.PopDue(clock.Now()); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("PopDue = %v, want [a]", got)
+	}
+}
+
+func TestSchedulerWakeResetsForEarlierDeadline(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+	s.Schedule("late", clock.Now().Add(10*time.Minute))
+	first := s.Wake()
+
+	s.Schedule("early", clock.Now().Add(time.Minute))
+	second := s.Wake()
+	if len(clock.timers) != 2 {
+		t.Fatalf("created %d timers, want 2", len(clock.timers))
+	}
+	if !clock.timers[0].stopped {
+		t.Error("the timer for the later deadline was not stopped")
+	}
+	if clock.timers[1].delay != time.Minute {
+		t.Errorf("new timer delay = %v, want 1m", clock.timers[1].delay)
+	}
+
+	clock.Advance(time.Minute)
+	if fired(first) {
+		t.Error("the replaced timer fired")
+	}
+	if !fired(second) {
+		t.Error("Wake did not fire at the earlier deadline")
+	}
+}
+
+func TestSchedulerWakeOverdue(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+	s.Schedule("a", clock.Now().Add(-time.Minute))
+
+	s.Wake()
+	if delay := clock.timers[0].delay; delay != 0 {
+		t.Errorf("timer delay for an overdue key = %v, want 0", delay)
+	}
+}
+
+// retriggerDeadline queues the same action at the start and again after a minute
+// under the given policy, and returns the deadline it ends up with.
+func retriggerDeadline(t *testing.T, clock *fakeClock, retrigger string, delay time.Duration) time.Time {
+	t.Helper()
+	hs := HubitatService{
+		AutomaticAction: make(map[string]ActionType),
+		Scheduler:       NewScheduler(clock),
+	}
+	action := ActionType{DeviceId: 101, PrimaryAction: "off", StartDelay: delay, Retrigger: retrigger}
+	hs.queueAction(action)
+	clock.Advance(time.Minute)
+	hs.queueAction(action)
+	pending, ok := hs.AutomaticAction[pendingKey(action)]
+	if !ok {
+		t.Fatalf("%s: action is not pending", retrigger)
+	}
+	if next, _ := hs.Scheduler.Next(); !next.Equal(pending.CurrentDelay) {
+		t.Errorf("%s: scheduled for %v, pending action says %v", retrigger, next, pending.CurrentDelay)
+	}
+	return pending.CurrentDelay
+}
+
+func TestRetriggerRestartAndExtendDiffer(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	restart := retriggerDeadline(t, clock, RetriggerRestart, 5*time.Minute)
+	if want := start.Add(6 * time.Minute); !restart.Equal(want) {
+		t.Errorf("restart deadline = %v, want %v", restart, want)
+	}
+
+	clock = newFakeClock()
+	extend := retriggerDeadline(t, clock, RetriggerExtend, 5*time.Minute)
+	if want := start.Add(10 * time.Minute); !extend.Equal(want) {
+		t.Errorf("extend deadline = %v, want %v", extend, want)
+	}
+}
+
+func TestRetriggerExtendCapped(t *testing.T) {
+	clock := newFakeClock()
+	hs := HubitatService{
+		AutomaticAction: make(map[string]ActionType),
+		Scheduler:       NewScheduler(clock),
+	}
+	action := ActionType{DeviceId: 101, PrimaryAction: "off", StartDelay: 5 * time.Minute, Retrigger: RetriggerExtend}
+	for i := 0; i < 10; i++ {
+		hs.queueAction(action)
+	}
+	want := clock.Now().Add(maxExtendDelays * action.StartDelay)
+	if got := hs.AutomaticAction[pendingKey(action)].CurrentDelay; !got.Equal(want) {
+		t.Errorf("deadline after 10 triggers = %v, want the cap %v", got, want)
+	}
+}
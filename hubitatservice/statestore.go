@@ -0,0 +1,154 @@
+package hubitatservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Overdue policies decide what happens on startup to saved actions that became due
+// while SoftRains was not running.
+const (
+	OverdueRun  = "run"  // run them straight away (the default)
+	OverdueDrop = "drop" // discard them
+)
+
+// savedState is what the state file holds: the pending actions and the deadlines
+// that would otherwise be forgotten on a restart.
+type savedState struct {
+	Pending             map[string]ActionType
+	DeviceBackoff       map[int]time.Time
+	ManualOverrideUntil map[int]time.Time
+}
+
+// StateStore saves the service's pending actions and deadlines to a JSON file so
+// they survive a restart. A nil store saves nothing.
+type StateStore struct {
+	path string
+	last []byte
+}
+
+// NewStateStore creates a store for the given file, or returns nil when path is empty.
+func NewStateStore(path string) *StateStore {
+	if path == "" {
+		return nil
+	}
+	return &StateStore{path: path}
+}
+
+// load reads the state file. A missing file is an empty state.
+func (s *StateStore) load() (savedState, error) {
+	var state savedState
+	if s == nil {
+		return state, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	s.last = data
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// save writes the state when it differs from what was last written. The file is
+// replaced in one step so a crash while writing cannot leave half of it behind.
+func (s *StateStore) save(state savedState) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, s.last) {
+		return nil
+	}
+	err = replaceFile(s.path, data)
+	if err != nil {
+		return err
+	}
+	s.last = data
+	return nil
+}
+
+// saveState writes the pending actions and the deadlines that have not passed yet.
+func (hs HubitatService) saveState() {
+	if hs.State == nil {
+		return
+	}
+	now := hs.Scheduler.Now()
+	// Calls still running are saved as pending, so they run again after a crash
+	pending := hs.Calls.Running()
+	for keyHash, action := range hs.AutomaticAction {
+		pending[keyHash] = action
+	}
+	state := savedState{
+		Pending:             pending,
+		DeviceBackoff:       activeDeadlines(hs.DeviceBackoff, now),
+		ManualOverrideUntil: activeDeadlines(hs.ManualOverrideUntil, now),
+	}
+	err := hs.State.save(state)
+	if err != nil {
+		log.Error().Msgf("Error saving state to %v: %v", hs.State.path, err)
+	}
+}
+
+// restoreState loads the saved state on startup. Actions that came due while the
+// service was down follow OverduePolicy; those overdue by more than OverdueMaxAge
+// are dropped whatever the policy.
+func (hs HubitatService) restoreState() {
+	state, err := hs.State.load()
+	if err != nil {
+		log.Error().Msgf("Error loading state from %v, starting empty: %v", hs.State.path, err)
+		return
+	}
+	now := hs.Scheduler.Now()
+	for keyHash, action := range state.Pending {
+		if _, ok := hs.HubitatDeviceList[action.DeviceId]; !ok {
+			log.Warn().Msgf("Dropping saved action for unknown device %v: %v", action.DeviceId, action.PrimaryAction)
+			continue
+		}
+		// Manual actions come from scenes and devices rather than rules, so they are kept
+		if hs.RuleActive != nil && !action.Manual && action.Rule != "" && !hs.RuleActive(action.Rule) {
+			log.Warn().Msgf("Dropping saved action for device %v of rule %v, which was removed or disabled: %v", action.DeviceId, action.Rule, action.PrimaryAction)
+			continue
+		}
+		if overdue := now.Sub(action.CurrentDelay); overdue > 0 {
+			if hs.OverduePolicy == OverdueDrop || (hs.OverdueMaxAge > 0 && overdue > hs.OverdueMaxAge) {
+				log.Warn().Msgf("Dropping saved action for device %v overdue by %v: %v", action.DeviceId, overdue.Round(time.Second), action.PrimaryAction)
+				continue
+			}
+			log.Info().Msgf("Running saved action for device %v overdue by %v: %v", action.DeviceId, overdue.Round(time.Second), action.PrimaryAction)
+		}
+		hs.setPending(keyHash, action)
+	}
+	for id, until := range activeDeadlines(state.DeviceBackoff, now) {
+		hs.DeviceBackoff[id] = until
+	}
+	for id, until := range activeDeadlines(state.ManualOverrideUntil, now) {
+		hs.ManualOverrideUntil[id] = until
+	}
+	if len(hs.AutomaticAction) > 0 {
+		log.Info().Msgf("Restored %d pending actions from %v", len(hs.AutomaticAction), hs.State.path)
+	}
+}
+
+// activeDeadlines returns the deadlines that are still in the future.
+func activeDeadlines(deadlines map[int]time.Time, now time.Time) map[int]time.Time {
+	active := make(map[int]time.Time)
+	for id, until := range deadlines {
+		if until.After(now) {
+			active[id] = until
+		}
+	}
+	return active
+}
@@ -0,0 +1,48 @@
+package hubitatservice
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreStateDropsInactiveRules(t *testing.T) {
+	clock := newFakeClock()
+	store := NewStateStore(filepath.Join(t.TempDir(), "state.json"))
+	due := clock.Now().Add(time.Minute)
+	saved := map[string]ActionType{
+		"active":   {Rule: "porch-off", DeviceId: 101, PrimaryAction: "off", CurrentDelay: due},
+		"removed":  {Rule: "deleted-rule", DeviceId: 101, PrimaryAction: "on", CurrentDelay: due},
+		"disabled": {Rule: "disabled-rule", DeviceId: 202, PrimaryAction: "open", CurrentDelay: due},
+		"scene":    {Rule: "scene:evening", DeviceId: 202, PrimaryAction: "close", CurrentDelay: due, Manual: true},
+	}
+	err := store.save(savedState{Pending: saved})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := HubitatService{
+		HubitatDeviceList:   map[int]HubitatDeviceInfo{101: {}, 202: {}},
+		AutomaticAction:     make(map[string]ActionType),
+		DeviceBackoff:       make(map[int]time.Time),
+		ManualOverrideUntil: make(map[int]time.Time),
+		Scheduler:           NewScheduler(clock),
+		State:               store,
+		RuleActive:          func(rule string) bool { return rule == "porch-off" },
+	}
+	hs.restoreState()
+
+	for _, key := range []string{"active", "scene"} {
+		if _, ok := hs.AutomaticAction[key]; !ok {
+			t.Errorf("saved action %q was not restored", key)
+		}
+	}
+	for _, key := range []string{"removed", "disabled"} {
+		if _, ok := hs.AutomaticAction[key]; ok {
+			t.Errorf("saved action %q of an inactive rule was restored", key)
+		}
+	}
+	if hs.Scheduler.Len() != 2 {
+		t.Errorf("scheduled %d actions, want 2", hs.Scheduler.Len())
+	}
+}
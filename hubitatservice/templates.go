@@ -0,0 +1,112 @@
+package hubitatservice
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TriggerEvent is the event that caused an action, made available to templates in
+// device URLs, post bodies and the primary and secondary actions.
+type TriggerEvent struct {
+	Camera      string
+	Zone        string
+	Label       string
+	SubLabel    string
+	Score       float64
+	EventID     string
+	SnapshotURL string
+	Time        time.Time
+	// DeviceID, Attribute and Value are set for Hubitat device events.
+	DeviceID  int
+	Attribute string
+	Value     string
+}
+
+var templateFuncs = template.FuncMap{
+	// percent formats a 0-1 score as a whole percentage, e.g. 0.92 -> "92%"
+	"percent": func(score float64) string {
+		return fmt.Sprintf("%.0f%%", score*100)
+	},
+	// pathescape is added to every placeholder of a URL template by renderURLTemplate
+	"pathescape": func(value interface{}) string {
+		return url.PathEscape(fmt.Sprint(value))
+	},
+}
+
+// renderTemplate fills text/template placeholders such as {{.Label}} from the trigger.
+// Text without placeholders is returned unchanged, as is text that fails to render.
+func renderTemplate(text string, trigger TriggerEvent) string {
+	return executeTemplate(text, trigger, false)
+}
+
+// renderURLTemplate is renderTemplate for text that becomes a URL. What each
+// placeholder prints is path-escaped, so values with spaces or % keep the URL valid.
+func renderURLTemplate(text string, trigger TriggerEvent) string {
+	return executeTemplate(text, trigger, true)
+}
+
+func executeTemplate(text string, trigger TriggerEvent, escape bool) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	tmpl, err := template.New("action").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		log.Warn().Msgf("Invalid template %q: %v", text, err)
+		return text
+	}
+	if escape {
+		escapeOutput(tmpl.Tree.Root)
+	}
+	var out strings.Builder
+	err = tmpl.Execute(&out, trigger)
+	if err != nil {
+		log.Warn().Msgf("Failed to render template %q: %v", text, err)
+		return text
+	}
+	return out.String()
+}
+
+// escapeOutput pipes every placeholder that prints something through pathescape,
+// the way html/template adds its escapers. Placeholders already ending in
+// urlquery or pathescape are left alone.
+func escapeOutput(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			escapeOutput(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 || endsInEscaper(n.Pipe) {
+			return
+		}
+		escaper := &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos}
+		escaper.Args = []parse.Node{parse.NewIdentifier("pathescape").SetPos(n.Pos)}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, escaper)
+	case *parse.IfNode:
+		escapeOutput(n.List)
+		escapeOutput(n.ElseList)
+	case *parse.RangeNode:
+		escapeOutput(n.List)
+		escapeOutput(n.ElseList)
+	case *parse.WithNode:
+		escapeOutput(n.List)
+		escapeOutput(n.ElseList)
+	}
+}
+
+func endsInEscaper(pipe *parse.PipeNode) bool {
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	if identifier, ok := last.Args[0].(*parse.IdentifierNode); ok {
+		return identifier.Ident == "urlquery" || identifier.Ident == "pathescape"
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package hubitatservice
+
+import "testing"
+
+func TestRenderURLTemplate(t *testing.T) {
+	trigger := TriggerEvent{Zone: "Front Door", SubLabel: "A/B", Score: 0.92}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"on", "on"},
+		{"setLevel/50", "setLevel/50"},
+		{"notify?text=hello%20there", "notify?text=hello%20there"},
+		{"{{.SubLabel}} at {{.Zone}}", "A%2FB at Front%20Door"},
+		{"{{percent .Score}}", "92%25"},
+		{"{{.Zone | urlquery}}", "Front+Door"},
+		{"{{if .SubLabel}}{{.SubLabel}}{{end}}/{{.Zone}}", "A%2FB/Front%20Door"},
+	}
+	for _, tt := range tests {
+		if got := renderURLTemplate(tt.text, trigger); got != tt.want {
+			t.Errorf("renderURLTemplate(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+	if got := renderTemplate("{{.SubLabel}} at {{.Zone}}", trigger); got != "A/B at Front Door" {
+		t.Errorf("renderTemplate escaped its output: %q", got)
+	}
+}
@@ -0,0 +1,234 @@
+package hubitatservice
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError is a single problem found in a config or actions file.
+// Path points at the offending field, e.g. "rules[3].deviceId".
+type ValidationError struct {
+	File    string `json:"file"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.File, e.Path, e.Message)
+}
+
+// ValidationErrors collects every problem found so they can be reported together.
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	lines := make([]string, len(v))
+	for i, e := range v {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Err returns the errors as an error, or nil when there are none.
+func (v ValidationErrors) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// Add appends an error for the given file and field path.
+func (v *ValidationErrors) Add(file string, path string, format string, args ...any) {
+	*v = append(*v, ValidationError{File: file, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateServiceConfig checks the HubitatConfig section of softrains.json.
+func ValidateServiceConfig(file string, config HubitatServiceConfig) ValidationErrors {
+	var errs ValidationErrors
+	if config.ActionsListLocation == "" {
+		errs.Add(file, "HubitatConfig.ActionsListLocation", "is required")
+	}
+	if config.Timeout <= 0 {
+		errs.Add(file, "HubitatConfig.Timeout", "must be positive, got %v", config.Timeout)
+	}
+	if config.ManualOverride < 0 {
+		errs.Add(file, "HubitatConfig.ManualOverride", "must not be negative, got %v", config.ManualOverride)
+	}
+	if config.CircuitBreakerThreshold < 0 {
+		errs.Add(file, "HubitatConfig.CircuitBreakerThreshold", "must not be negative, got %d", config.CircuitBreakerThreshold)
+	}
+	if config.CircuitBreakerCooldown < 0 {
+		errs.Add(file, "HubitatConfig.CircuitBreakerCooldown", "must not be negative, got %v", config.CircuitBreakerCooldown)
+	}
+	hubIDs := make(map[int]bool)
+	for i, hub := range config.Hubs {
+		path := fmt.Sprintf("HubitatConfig.Hubs[%d]", i)
+		if hub.APIID <= 0 {
+			errs.Add(file, path+".APIId", "must be positive, got %d", hub.APIID)
+		} else if hubIDs[hub.APIID] {
+			errs.Add(file, path+".APIId", "%d is used by another hub", hub.APIID)
+		}
+		hubIDs[hub.APIID] = true
+		if u, err := url.Parse(hub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs.Add(file, path+".URL", "must be an http or https URL, got %q", hub.URL)
+		}
+	}
+	switch config.OverduePolicy {
+	case "", OverdueRun, OverdueDrop:
+	default:
+		errs.Add(file, "HubitatConfig.OverduePolicy", "must be %q or %q, got %q", OverdueRun, OverdueDrop, config.OverduePolicy)
+	}
+	if config.OverdueMaxAge < 0 {
+		errs.Add(file, "HubitatConfig.OverdueMaxAge", "must not be negative, got %v", config.OverdueMaxAge)
+	}
+
+	for key, device := range config.HubitatDevices {
+		path := "HubitatConfig.HubitatDevices." + strconv.Itoa(key)
+		if device.DeviceID != key {
+			errs.Add(file, path+".DeviceId", "is %d but the device is listed under %d", device.DeviceID, key)
+		}
+		if device.DeviceBackoff < 0 {
+			errs.Add(file, path+".DeviceBackoff", "must not be negative, got %v", device.DeviceBackoff)
+		}
+		if device.Retries != nil && *device.Retries < 0 {
+			errs.Add(file, path+".Retries", "must not be negative, got %d", *device.Retries)
+		}
+		if device.RetryBackoff < 0 {
+			errs.Add(file, path+".RetryBackoff", "must not be negative, got %v", device.RetryBackoff)
+		}
+		if device.RequestTimeout < 0 {
+			errs.Add(file, path+".RequestTimeout", "must not be negative, got %v", device.RequestTimeout)
+		}
+		// Each device type checks the settings its actuator needs
+		actuator, ok := actuatorFor(device.DeviceType())
+		if !ok {
+			errs.Add(file, path+".Type", "unknown type %q, expected one of %v", device.Type, DeviceTypes())
+			continue
+		}
+		problems := actuator.Validate(device)
+		fields := make([]string, 0, len(problems))
+		for field := range problems {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			errs.Add(file, path+"."+field, "%s", problems[field])
+		}
+	}
+
+	for name, scene := range config.Scenes {
+		path := "HubitatConfig.Scenes." + name
+		if len(scene.Commands) == 0 {
+			errs.Add(file, path+".Commands", "must not be empty")
+		}
+		for i, command := range scene.Commands {
+			commandPath := fmt.Sprintf("%s.Commands[%d]", path, i)
+			if _, ok := config.HubitatDevices[command.DeviceID]; !ok {
+				errs.Add(file, commandPath+".deviceId", "device %d not found in HubitatDevices", command.DeviceID)
+			}
+			if command.Delay < 0 {
+				errs.Add(file, commandPath+".delay", "must not be negative, got %v", command.Delay)
+			}
+			if command.PrimaryAction == "" {
+				errs.Add(file, commandPath+".primaryAction", "is required")
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateActions checks the rules in an actions file against the configured devices and scenes.
+func ValidateActions(file string, actions []ActionInput, config HubitatServiceConfig) ValidationErrors {
+	var errs ValidationErrors
+	ids := make(map[string]string, len(actions))
+	counts := make(map[string]int)
+	// Cancels of rule:<id> are checked once every rule's ID is known
+	type ruleRef struct{ file, path, id string }
+	var refs []ruleRef
+	for _, action := range actions {
+		// Rules from included files are reported against their own file
+		ruleFile := file
+		if action.Source != "" {
+			ruleFile = action.Source
+		}
+		i := counts[ruleFile]
+		counts[ruleFile]++
+
+		path := fmt.Sprintf("rules[%d]", i)
+		if action.ID != "" {
+			path = fmt.Sprintf("rules[%d] (id %s)", i, action.ID)
+			if first, ok := ids[action.ID]; ok {
+				errs.Add(ruleFile, path+".id", "duplicates %s", first)
+			}
+			ids[action.ID] = fmt.Sprintf("%s rules[%d]", ruleFile, i)
+		}
+
+		if action.CameraSource == "" {
+			errs.Add(ruleFile, path+".cameraSource", "is required")
+		}
+		if event, ok := strings.CutPrefix(action.CameraSource, HubitatTriggerPrefix); ok {
+			parts := strings.SplitN(event, ":", 3)
+			if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+				errs.Add(ruleFile, path+".cameraSource", "must look like hubitat:<deviceId>:<attribute>:<value>, got %q", action.CameraSource)
+			} else if _, err := strconv.Atoi(parts[0]); err != nil && !strings.ContainsAny(parts[0], "*?[") {
+				errs.Add(ruleFile, path+".cameraSource", "device %q is not a number", parts[0])
+			}
+			if action.AbsentFor > 0 {
+				errs.Add(ruleFile, path+".absentFor", "is not supported for hubitat triggers")
+			}
+		}
+		if action.Delay < 0 {
+			errs.Add(ruleFile, path+".delay", "must not be negative, got %v", action.Delay)
+		}
+		if action.Backoff < 0 {
+			errs.Add(ruleFile, path+".backoff", "must not be negative, got %v", action.Backoff)
+		}
+		if action.AbsentFor < 0 {
+			errs.Add(ruleFile, path+".absentFor", "must not be negative, got %v", action.AbsentFor)
+		}
+
+		switch action.Retrigger {
+		case "", RetriggerRestart, RetriggerExtend, RetriggerIgnore, RetriggerCancel:
+		default:
+			errs.Add(ruleFile, path+".retrigger", "unknown policy %q", action.Retrigger)
+		}
+		if action.Conflict != "" && action.Conflict != ConflictPriority {
+			errs.Add(ruleFile, path+".conflict", "unknown policy %q", action.Conflict)
+		}
+		if action.When != "" {
+			condition, err := ParseStateCondition(action.When)
+			if err != nil {
+				errs.Add(ruleFile, path+".when", "%v", err)
+			} else if _, ok := config.HubitatDevices[condition.DeviceID]; !ok {
+				errs.Add(ruleFile, path+".when", "device %d not found in HubitatDevices", condition.DeviceID)
+			}
+		}
+
+		if action.Scene != "" {
+			if _, ok := config.Scenes[action.Scene]; !ok {
+				errs.Add(ruleFile, path+".scene", "scene %q not found in Scenes", action.Scene)
+			}
+			continue
+		}
+		if action.PrimaryAction == "" {
+			errs.Add(ruleFile, path+".primaryAction", "is required")
+		}
+		if _, ok := config.HubitatDevices[action.DeviceID]; !ok {
+			errs.Add(ruleFile, path+".deviceId", "device %d not found in HubitatDevices", action.DeviceID)
+		}
+		if rule, ok := strings.CutPrefix(action.SecondaryAction, RulePrefix); ok && action.PrimaryAction == ActionCancel {
+			refs = append(refs, ruleRef{ruleFile, path + ".secondaryAction", rule})
+		}
+	}
+	for _, ref := range refs {
+		if _, ok := ids[ref.id]; !ok {
+			errs.Add(ref.file, ref.path, "rule %q not found", ref.id)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,22 @@
+package hubitatservice
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateActionsCancelReference(t *testing.T) {
+	config := HubitatServiceConfig{HubitatDevices: map[int]HubitatDeviceInfo{101: {}}}
+	rules := []ActionInput{
+		{ID: "porch-off", DeviceID: 101, PrimaryAction: "off", CameraSource: "front:person"},
+		{ID: "stop-off", DeviceID: 101, PrimaryAction: ActionCancel, SecondaryAction: RulePrefix + "porch-off", CameraSource: "door:person"},
+	}
+	if errs := ValidateActions("actions.json", rules, config); len(errs) != 0 {
+		t.Fatalf("valid rules reported: %v", errs)
+	}
+
+	errs := ValidateActions("actions.json", rules[1:], config)
+	if len(errs) != 1 || !strings.Contains(errs.Error(), `rule "porch-off" not found`) {
+		t.Errorf("errors after deleting the cancelled rule = %v, want one for the missing rule", errs)
+	}
+}
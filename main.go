@@ -1,9 +1,27 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/bigjimnolan/softrains/controller"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			// softrains validate [config file], defaulting to SOFTRAINS_CONFIG_FILE
+			configPath := os.Getenv("SOFTRAINS_CONFIG_FILE")
+			if len(os.Args) > 2 {
+				configPath = os.Args[2]
+			}
+			os.Exit(controller.Validate(configPath))
+		default:
+			fmt.Printf("unknown command: %s\nusage: softrains [validate [config file]]\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
 	controller.StartHere()
 }
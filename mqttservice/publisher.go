@@ -0,0 +1,181 @@
+package mqttservice
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// publishTimeout bounds a whole publish to an external broker, from dial to disconnect.
+const publishTimeout = 10 * time.Second
+
+// publishCount numbers the connections to external brokers. Device calls run
+// concurrently, and a broker drops a session when another connects with its client
+// ID, so each connection needs an ID of its own.
+var publishCount atomic.Uint64
+
+// Publisher returns the function device commands are published with: the embedded
+// broker's inline client, or the external PublishBroker when one is set.
+func (mqt MQTTService) Publisher() func(topic string, payload []byte, retain bool, qos byte) error {
+	if mqt.PublishBroker == "" {
+		return Publish
+	}
+	return externalPublisher{broker: mqt.PublishBroker, clientID: "softrains-pub"}.Publish
+}
+
+// externalPublisher publishes to another broker, opening an MQTT 3.1.1 connection
+// for each message. Commands are infrequent, so there is no session to keep alive
+// or recover. Each connection's client ID is clientID with a number appended.
+type externalPublisher struct {
+	broker   string
+	clientID string
+}
+
+func (p externalPublisher) Publish(topic string, payload []byte, retain bool, qos byte) error {
+	broker, err := url.Parse(p.broker)
+	if err != nil {
+		return fmt.Errorf("mqtt broker %q: %w", p.broker, err)
+	}
+
+	dialer := &net.Dialer{Timeout: publishTimeout}
+	var conn net.Conn
+	switch broker.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", broker.Host)
+	case "tls", "ssl", "mqtts":
+		conn, err = tls.DialWithDialer(dialer, "tcp", broker.Host, &tls.Config{ServerName: broker.Hostname()})
+	default:
+		return fmt.Errorf("mqtt broker %q: unknown scheme %q", p.broker, broker.Scheme)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(publishTimeout))
+	reader := bufio.NewReader(conn)
+
+	connect := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 4,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: p.clientID + "-" + strconv.FormatUint(publishCount.Add(1), 10),
+		},
+	}
+	if broker.User != nil {
+		connect.Connect.UsernameFlag = true
+		connect.Connect.Username = []byte(broker.User.Username())
+		if password, ok := broker.User.Password(); ok {
+			connect.Connect.PasswordFlag = true
+			connect.Connect.Password = []byte(password)
+		}
+	}
+	err = writePacket(conn, connect.ConnectEncode)
+	if err != nil {
+		return err
+	}
+	connack, err := readPacket(reader, packets.Connack)
+	if err != nil {
+		return err
+	}
+	if connack.ReasonCode != 0 {
+		return fmt.Errorf("mqtt broker %v refused the connection, code %d", broker.Host, connack.ReasonCode)
+	}
+
+	publish := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: qos, Retain: retain},
+		ProtocolVersion: 4,
+		TopicName:       topic,
+		Payload:         payload,
+	}
+	if qos > 0 {
+		publish.PacketID = 1
+	}
+	err = writePacket(conn, publish.PublishEncode)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the broker to take the message before disconnecting
+	switch qos {
+	case 1:
+		_, err = readPacket(reader, packets.Puback)
+	case 2:
+		_, err = readPacket(reader, packets.Pubrec)
+		if err != nil {
+			return err
+		}
+		pubrel := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, ProtocolVersion: 4, PacketID: 1}
+		err = writePacket(conn, pubrel.PubrelEncode)
+		if err != nil {
+			return err
+		}
+		_, err = readPacket(reader, packets.Pubcomp)
+	}
+	if err != nil {
+		return err
+	}
+
+	disconnect := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}, ProtocolVersion: 4}
+	return writePacket(conn, disconnect.DisconnectEncode)
+}
+
+func writePacket(w io.Writer, encode func(*bytes.Buffer) error) error {
+	var buf bytes.Buffer
+	err := encode(&buf)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// readPacket reads the next packet, which must be of the expected type.
+func readPacket(r *bufio.Reader, expected byte) (packets.Packet, error) {
+	var pk packets.Packet
+	header, err := r.ReadByte()
+	if err != nil {
+		return pk, err
+	}
+	err = pk.FixedHeader.Decode(header)
+	if err != nil {
+		return pk, err
+	}
+	if pk.FixedHeader.Type != expected {
+		return pk, fmt.Errorf("mqtt: expected packet type %d, got %d", expected, pk.FixedHeader.Type)
+	}
+	length, _, err := packets.DecodeLength(r)
+	if err != nil {
+		return pk, err
+	}
+	pk.FixedHeader.Remaining = length
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return pk, err
+	}
+
+	pk.ProtocolVersion = 4
+	switch expected {
+	case packets.Connack:
+		err = pk.ConnackDecode(body)
+	case packets.Puback:
+		err = pk.PubackDecode(body)
+	case packets.Pubrec:
+		err = pk.PubrecDecode(body)
+	case packets.Pubcomp:
+		err = pk.PubcompDecode(body)
+	}
+	return pk, err
+}
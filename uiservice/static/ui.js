@@ -6,31 +6,63 @@ function showNotification(msg, success=true) {
   setTimeout(() => { n.style.display = 'none'; }, 3000);
 }
 
+// checkResponse resolves with the body of a successful response and rejects with
+// the body otherwise, so validation errors from the server can be shown.
+function checkResponse(r) {
+  return r.ok ? r.text() : r.text().then(body => Promise.reject(body || r.statusText));
+}
+
+function formatError(err) {
+  try {
+    let errs = JSON.parse(err);
+    if (Array.isArray(errs)) return ': ' + errs.map(e => `${e.path}: ${e.message}`).join('; ');
+  } catch (e) {}
+  return err ? ': ' + err : '';
+}
+
 function closeModal() {
   document.getElementById('modal-bg').style.display = 'none';
   document.getElementById('modal-content').innerHTML = '';
 }
 
 function showActionModal(mode, id, el) {
-  let action = {DeviceID:'', Delay:'', PrimaryAction:'', SecondaryAction:'', CameraSource:'', Backoff:''};
+  let action = {ID:'', DeviceID:'', Delay:'', PrimaryAction:'', SecondaryAction:'', CameraSource:'', Backoff:'', Scene:'', Retrigger:'', AbsentFor:'', Priority:'', Conflict:'', When:''};
   if (mode === 'edit' && el) {
     let row = el.closest('tr').children;
-    action.DeviceID = row[0].textContent;
-    action.Delay = row[1].textContent;
-    action.PrimaryAction = row[2].textContent;
-    action.SecondaryAction = row[3].textContent;
-    action.CameraSource = row[4].textContent;
-    action.Backoff = row[5].textContent;
+    action.ID = row[0].textContent;
+    action.DeviceID = row[1].textContent;
+    action.Delay = row[2].textContent;
+    action.PrimaryAction = row[3].textContent;
+    action.SecondaryAction = row[4].textContent;
+    action.CameraSource = row[5].textContent;
+    action.Backoff = row[6].textContent;
+    action.Scene = row[7].textContent;
+    action.Retrigger = row[8].textContent;
+    action.AbsentFor = row[9].textContent;
+    action.Priority = row[10].textContent;
+    action.Conflict = row[11].textContent;
+    action.When = row[12].textContent;
   }
   let html = `
     <h3>${mode === 'add' ? 'Add' : 'Edit'} Action</h3>
-    <form onsubmit="submitAction(event, '${mode}', '${action.DeviceID}')">
-      <label>DeviceID: <input name="deviceId" value="${action.DeviceID}" ${mode==='edit'?'readonly':''}></label><br>
-      <label>Delay: <input name="delay" value="${action.Delay}"></label><br>
-      <label>PrimaryAction: <input name="primaryAction" value="${action.PrimaryAction}"></label><br>
-      <label>SecondaryAction: <input name="secondaryAction" value="${action.SecondaryAction}"></label><br>
-      <label>CameraSource: <input name="cameraSource" value="${action.CameraSource}"></label><br>
-      <label>Backoff: <input name="backoff" value="${action.Backoff}"></label><br>
+    <form onsubmit="submitAction(event, '${mode}', '${action.ID}')">
+      <input type="hidden" name="id" value="${escapeHTML(action.ID)}">
+      <label>DeviceID: <input name="deviceId" value="${escapeHTML(action.DeviceID)}"></label><br>
+      <label>Delay: <input name="delay" value="${escapeHTML(action.Delay)}"></label><br>
+      <label>PrimaryAction: <input name="primaryAction" value="${escapeHTML(action.PrimaryAction)}"></label><br>
+      <label>SecondaryAction: <input name="secondaryAction" value="${escapeHTML(action.SecondaryAction)}"></label><br>
+      <label>CameraSource: <input name="cameraSource" value="${escapeHTML(action.CameraSource)}"></label><br>
+      <label>Backoff: <input name="backoff" value="${escapeHTML(action.Backoff)}"></label><br>
+      <label>Scene (replaces DeviceID): <input name="scene" value="${escapeHTML(action.Scene)}"></label><br>
+      <label>Retrigger: <select name="retrigger">
+        ${['', 'restart', 'extend', 'ignore', 'cancel'].map(p => `<option value="${p}" ${p===action.Retrigger?'selected':''}>${p || 'restart (default)'}</option>`).join('')}
+      </select></label><br>
+      <label>AbsentFor (fire after this long without a detection, e.g. 10m): <input name="absentFor" value="${escapeHTML(action.AbsentFor)}"></label><br>
+      <label>Priority: <input name="priority" value="${escapeHTML(action.Priority)}"></label><br>
+      <label>Conflict: <select name="conflict">
+        ${['', 'priority'].map(p => `<option value="${p}" ${p===action.Conflict?'selected':''}>${p || 'none'}</option>`).join('')}
+      </select></label><br>
+      <label>When (only fire while a device attribute matches, e.g. 404:switch=off): <input name="when" value="${escapeHTML(action.When)}"></label><br>
       <button type="submit">${mode === 'add' ? 'Create' : 'Update'}</button>
     </form>
   `;
@@ -39,23 +71,34 @@ function showActionModal(mode, id, el) {
 }
 
 function showDeviceModal(mode, id, el) {
-  let device = {DeviceId:'', APIId:'', DeviceURL:'', DeviceBackoff:'', Notes:''};
+  let device = {DeviceId:'', APIId:'', DeviceURL:'', DeviceBackoff:'', Type:'', Topic:'', QoS:'', Retain:false, EntityID:'', PostBody:''};
   if (mode === 'edit' && el) {
     let row = el.closest('tr').children;
     device.DeviceId = row[0].textContent;
     device.APIId = row[1].textContent;
     device.DeviceURL = row[2].textContent;
     device.DeviceBackoff = row[3].textContent;
-    device.Notes = row[4].textContent;
+    device.Type = row[4].textContent;
+    device.Topic = row[5].textContent;
+    device.QoS = el.closest('tr').dataset.qos;
+    device.Retain = el.closest('tr').dataset.retain === 'true';
+    device.EntityID = el.closest('tr').dataset.entity;
+    device.PostBody = el.closest('tr').dataset.body;
   }
   let html = `
     <h3>${mode === 'add' ? 'Add' : 'Edit'} Device</h3>
     <form onsubmit="submitDevice(event, '${mode}', '${device.DeviceId}')">
-      <label>DeviceId: <input name="deviceId" value="${device.DeviceId}" ${mode==='edit'?'readonly':''}></label><br>
-      <label>APIId: <input name="apiId" value="${device.APIId}"></label><br>
-      <label>DeviceURL: <input name="deviceUrl" value="${device.DeviceURL}"></label><br>
-      <label>DeviceBackoff: <input name="deviceBackoff" value="${device.DeviceBackoff}"></label><br>
-      <label>Notes: <input name="notes" value="${device.Notes}"></label><br>
+      <label>DeviceId: <input name="deviceId" value="${escapeHTML(device.DeviceId)}" ${mode==='edit'?'readonly':''}></label><br>
+      <label>APIId: <input name="apiId" value="${escapeHTML(device.APIId)}"></label><br>
+      <label>DeviceURL: <input name="deviceUrl" value="${escapeHTML(device.DeviceURL)}"></label><br>
+      <label>DeviceBackoff: <input name="deviceBackoff" value="${escapeHTML(device.DeviceBackoff)}"></label><br>
+      <label>Type (maker, webhook, mqtt, homeassistant or log; empty for maker): <input name="type" value="${escapeHTML(device.Type)}"></label><br>
+      <label>Topic (mqtt devices): <input name="topic" value="${escapeHTML(device.Topic)}"></label><br>
+      <label>QoS (mqtt devices, 0-2): <input name="qos" value="${escapeHTML(device.QoS)}"></label><br>
+      <label>Retain (mqtt devices): <input type="checkbox" name="retain" value="true" ${device.Retain ? 'checked' : ''}></label><br>
+      <label>EntityID (homeassistant devices): <input name="entityId" value="${escapeHTML(device.EntityID)}"></label><br>
+      <label>Token (homeassistant devices${mode === 'edit' ? ', leave empty to keep' : ''}): <input name="token" type="password"></label><br>
+      <label>PostBody (webhook devices; payload for mqtt, service data for homeassistant): <input name="postBody" value="${escapeHTML(device.PostBody)}"></label><br>
       <button type="submit">${mode === 'add' ? 'Create' : 'Update'}</button>
     </form>
   `;
@@ -71,26 +114,26 @@ function submitAction(e, mode, id) {
     method: 'POST',
     body: data,
     credentials: 'same-origin'
-  }).then(r => r.ok ? r.text() : Promise.reject(r.statusText))
+  }).then(checkResponse)
     .then(() => {
       showNotification(`Action ${mode === 'add' ? 'created' : 'updated'} successfully!`);
       closeModal();
       setTimeout(() => location.reload(), 60000);
     })
-    .catch(() => showNotification('Failed to update action', false));
+    .catch(err => showNotification('Failed to update action' + formatError(err), false));
 }
 
 function deleteAction(id) {
   if (!confirm('Delete this action?')) return;
-  fetch(`/action?mode=delete&id=${id}`, {
+  fetch(`/action?mode=delete&id=${encodeURIComponent(id)}`, {
     method: 'DELETE',
     credentials: 'same-origin'
-  }).then(r => r.ok ? r.text() : Promise.reject(r.statusText))
+  }).then(checkResponse)
     .then(() => {
       showNotification('Action deleted successfully!');
       setTimeout(() => location.reload(), 60000);
     })
-    .catch(() => showNotification('Failed to delete action', false));
+    .catch(err => showNotification('Failed to delete action' + formatError(err), false));
 }
 
 function submitDevice(e, mode, id) {
@@ -101,13 +144,13 @@ function submitDevice(e, mode, id) {
     method: 'POST',
     body: data,
     credentials: 'same-origin'
-  }).then(r => r.ok ? r.text() : Promise.reject(r.statusText))
+  }).then(checkResponse)
     .then(() => {
       showNotification(`Device ${mode === 'add' ? 'created' : 'updated'} successfully!`);
       closeModal();
       setTimeout(() => location.reload(), 60000);
     })
-    .catch(() => showNotification('Failed to update device', false));
+    .catch(err => showNotification('Failed to update device' + formatError(err), false));
 }
 
 function deleteDevice(id) {
@@ -115,10 +158,192 @@ function deleteDevice(id) {
   fetch(`/device?mode=delete&id=${id}`, {
     method: 'DELETE',
     credentials: 'same-origin'
-  }).then(r => r.ok ? r.text() : Promise.reject(r.statusText))
+  }).then(checkResponse)
     .then(() => {
       showNotification('Device deleted successfully!');
       setTimeout(() => location.reload(), 60000);
     })
-    .catch(() => showNotification('Failed to delete device', false));
-}
\ No newline at end of file
+    .catch(err => showNotification('Failed to delete device' + formatError(err), false));
+}
+
+function showSceneModal(mode, name, el) {
+  let scene = {Name:'', Commands:''};
+  if (mode === 'edit' && el) {
+    let row = el.closest('tr').children;
+    scene.Name = row[0].textContent;
+    scene.Commands = row[1].textContent.trim();
+  }
+  let html = `
+    <h3>${mode === 'add' ? 'Add' : 'Edit'} Scene</h3>
+    <form onsubmit="submitScene(event, '${mode}')">
+      <label>Name: <input name="name" value="${scene.Name}" ${mode==='edit'?'readonly':''}></label><br>
+      <label>Commands, one per line (deviceId, delay, primaryAction, secondaryAction):<br>
+        <textarea name="commands" rows="6" cols="40">${scene.Commands}</textarea></label><br>
+      <button type="submit">${mode === 'add' ? 'Create' : 'Update'}</button>
+    </form>
+  `;
+  document.getElementById('modal-content').innerHTML = html;
+  document.getElementById('modal-bg').style.display = 'block';
+}
+
+function submitScene(e, mode) {
+  e.preventDefault();
+  let form = e.target;
+  let data = new URLSearchParams(new FormData(form));
+  fetch(`/scene?mode=${mode}`, {
+    method: 'POST',
+    body: data,
+    credentials: 'same-origin'
+  }).then(checkResponse)
+    .then(() => {
+      showNotification(`Scene ${mode === 'add' ? 'created' : 'updated'} successfully!`);
+      closeModal();
+      setTimeout(() => location.reload(), 60000);
+    })
+    .catch(err => showNotification('Failed to update scene' + formatError(err), false));
+}
+
+function runScene(name) {
+  let data = new URLSearchParams({name: name});
+  fetch(`/scene?mode=run`, {
+    method: 'POST',
+    body: data,
+    credentials: 'same-origin'
+  }).then(checkResponse)
+    .then(() => showNotification(`Scene ${name} started`))
+    .catch(err => showNotification('Failed to run scene' + formatError(err), false));
+}
+
+function deleteScene(name) {
+  if (!confirm('Delete this scene?')) return;
+  fetch(`/scene?name=${encodeURIComponent(name)}`, {
+    method: 'DELETE',
+    credentials: 'same-origin'
+  }).then(checkResponse)
+    .then(() => {
+      showNotification('Scene deleted successfully!');
+      setTimeout(() => location.reload(), 60000);
+    })
+    .catch(err => showNotification('Failed to delete scene' + formatError(err), false));
+}
+
+function ruleCommand(id, command, duration) {
+  let data = new URLSearchParams({id: id, command: command});
+  if (duration) data.set('for', duration);
+  fetch(`/api/rule`, {
+    method: 'POST',
+    body: data,
+    credentials: 'same-origin'
+  }).then(checkResponse)
+    .then(() => {
+      showNotification(`Rule ${command}d successfully!`);
+      setTimeout(() => location.reload(), 1000);
+    })
+    .catch(err => showNotification(`Failed to ${command} rule` + formatError(err), false));
+}
+
+function snoozeRule(id) {
+  let duration = prompt('Snooze for how long? (e.g. 30m, 3h)', '3h');
+  if (!duration) return;
+  ruleCommand(id, 'snooze', duration);
+}
+
+function suggestRule(cameraSource) {
+  showActionModal('add');
+  document.querySelector('#modal-content input[name="cameraSource"]').value = cameraSource;
+}
+function retryFailed(id) {
+  let data = new URLSearchParams({id: id});
+  fetch(`/api/failed`, {
+    method: 'POST',
+    body: data,
+    credentials: 'same-origin'
+  }).then(checkResponse)
+    .then(() => {
+      showNotification('Action queued again');
+      setTimeout(() => location.reload(), 1000);
+    })
+    .catch(err => showNotification('Failed to retry action' + formatError(err), false));
+}
+
+// escapeHTML makes text safe to put in HTML, including inside quoted attribute values.
+function escapeHTML(text) {
+  let div = document.createElement('div');
+  div.textContent = text;
+  return div.innerHTML.replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+}
+
+function showImportModal() {
+  fetch(`/api/hubs`, {credentials: 'same-origin'})
+    .then(checkResponse)
+    .then(body => {
+      let hubs = JSON.parse(body) || [];
+      let html = `<h3>Import from Hub</h3>`;
+      if (hubs.length === 0) {
+        html += `<p>No hubs configured. Add them under HubitatConfig.Hubs in the config file.</p>`;
+      } else {
+        html += `
+          <label>Hub: <select id="import-hub">
+            ${hubs.map(h => `<option value="${h.APIId}">${escapeHTML(h.Name || h.URL)} (${h.APIId})</option>`).join('')}
+          </select></label>
+          <button onclick="loadHubDevices()">Load devices</button>
+          <div id="import-devices"></div>
+        `;
+      }
+      document.getElementById('modal-content').innerHTML = html;
+      document.getElementById('modal-bg').style.display = 'block';
+    })
+    .catch(err => showNotification('Failed to load hubs' + formatError(err), false));
+}
+
+function loadHubDevices() {
+  let hub = document.getElementById('import-hub').value;
+  let target = document.getElementById('import-devices');
+  target.textContent = 'Loading...';
+  fetch(`/api/hubs?hub=${encodeURIComponent(hub)}`, {credentials: 'same-origin'})
+    .then(checkResponse)
+    .then(body => {
+      let devices = JSON.parse(body) || [];
+      if (devices.length === 0) {
+        target.textContent = 'The hub has no devices shared with the Maker API.';
+        return;
+      }
+      target.innerHTML = `
+        <form onsubmit="importDevices(event, '${hub}')">
+          <table>
+            <thead><tr><th></th><th>ID</th><th>Label</th><th>Type</th><th>Commands</th><th>Status</th></tr></thead>
+            <tbody>
+              ${devices.map(d => `
+                <tr title="${escapeHTML((d.Capabilities || []).join(', '))}">
+                  <td><input type="checkbox" name="id" value="${d.ID}" ${d.Status === 'new' ? 'checked' : ''} ${d.Status !== 'new' && d.Status !== 'imported' ? 'disabled' : ''}></td>
+                  <td>${d.ID}</td>
+                  <td>${escapeHTML(d.Label || d.Name)}</td>
+                  <td>${escapeHTML(d.Type)}</td>
+                  <td>${escapeHTML((d.Commands || []).join(', '))}</td>
+                  <td>${escapeHTML(d.Status)}</td>
+                </tr>`).join('')}
+            </tbody>
+          </table>
+          <button type="submit">Import selected</button>
+        </form>
+      `;
+    })
+    .catch(err => { target.textContent = ''; showNotification('Failed to load devices' + formatError(err), false); });
+}
+
+function importDevices(e, hub) {
+  e.preventDefault();
+  let data = new URLSearchParams(new FormData(e.target));
+  data.set('hub', hub);
+  fetch(`/api/hubs`, {
+    method: 'POST',
+    body: data,
+    credentials: 'same-origin'
+  }).then(checkResponse)
+    .then(msg => {
+      showNotification(msg);
+      closeModal();
+      setTimeout(() => location.reload(), 1000);
+    })
+    .catch(err => showNotification('Failed to import devices' + formatError(err), false));
+}
@@ -2,12 +2,16 @@ package uiservice
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,11 +27,41 @@ type UIService struct {
 	TLSListenPort    string
 	WebFolderDocRoot string
 	authPassword     string
+	webhookToken     string
 	actionsMutex     sync.Mutex
 	configMutex      sync.Mutex
 	UpdateChannel    *chan UpdateMsg
+	Conflicts        *hubitatservice.ConflictLog    `json:"-"`
+	Failures         *hubitatservice.FailureLog     `json:"-"`
+	Results          *hubitatservice.ResultHistory  `json:"-"`
+	Breaker          *hubitatservice.CircuitBreaker `json:"-"`
+	States           *hubitatservice.DeviceStates   `json:"-"`
+	Unmatched        func() []UnmatchedDetection    `json:"-"`
+	// Hubs lists the Maker API instances devices can be imported from.
+	Hubs func() []hubitatservice.HubConfig `json:"-"`
+	// Validate checks rules and HubitatConfig before any change is saved.
+	Validate func([]hubitatservice.ActionInput, hubitatservice.HubitatServiceConfig) hubitatservice.ValidationErrors `json:"-"`
+	// LoadConfig decodes HubitatConfig from a config document the way the controller
+	// does, with ${ENV} references and SOFTRAINS__ overrides applied.
+	LoadConfig func([]byte) (hubitatservice.HubitatServiceConfig, error) `json:"-"`
 }
 
+// UnmatchedDetection counts a zone:label key that no rule matched, so the dashboard
+// can suggest rules for detections that actually happen.
+type UnmatchedDetection struct {
+	Key      string
+	Count    int
+	LastSeen time.Time
+}
+
+// Rule commands accepted by RuleCommand and the /api/rule endpoint.
+const (
+	RuleEnable   = "enable"
+	RuleDisable  = "disable"
+	RuleSnooze   = "snooze"
+	RuleUnsnooze = "unsnooze"
+)
+
 type UpdateMsg struct {
 	UpdateType string      `json:"updateType"`
 	UpdateData interface{} `json:"updateData"`
@@ -35,10 +69,18 @@ type UpdateMsg struct {
 
 func (ui *UIService) Start() error {
 	ui.authPassword = os.Getenv("SOFTRAINS_AUTH_PASSWORD")
+	ui.webhookToken = os.Getenv("SOFTRAINS_WEBHOOK_TOKEN")
 	http.HandleFunc("/", ui.loginHandler)
 	http.HandleFunc("/dashboard", ui.authMiddleware(ui.dashboardHandler))
 	http.HandleFunc("/action", ui.authMiddleware(ui.actionHandler))
 	http.HandleFunc("/device", ui.authMiddleware(ui.deviceHandler))
+	http.HandleFunc("/scene", ui.authMiddleware(ui.sceneHandler))
+	http.HandleFunc("/api/rule", ui.authMiddleware(ui.ruleAPIHandler))
+	http.HandleFunc("/api/failed", ui.authMiddleware(ui.failedAPIHandler))
+	http.HandleFunc("/api/results", ui.authMiddleware(ui.resultsAPIHandler))
+	http.HandleFunc("/api/hubs", ui.authMiddleware(ui.hubsAPIHandler))
+	http.HandleFunc("/api/state", ui.authMiddleware(ui.stateAPIHandler))
+	http.HandleFunc("/hubitat/events", ui.hubitatEventHandler)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(ui.WebFolderDocRoot+"static"))))
 
 	if _, err := os.Stat(ui.ServerCertPath); err != nil {
@@ -83,13 +125,25 @@ func (ui *UIService) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// dashboardResults is how many of the latest action results the dashboard shows.
+const dashboardResults = 50
+
 func (ui *UIService) dashboardHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.ParseFiles(ui.WebFolderDocRoot + "templates/dashboard.html"))
 	actions, _ := ui.loadActions()
 	devices, _ := ui.loadDevices()
+	scenes, _ := ui.loadScenes()
 	err := tmpl.Execute(w, map[string]interface{}{
-		"Actions": actions,
-		"Devices": devices,
+		"Now":       time.Now(),
+		"Actions":   actions,
+		"Devices":   devices,
+		"Scenes":    scenes,
+		"Conflicts": ui.Conflicts.List(),
+		"Failed":    ui.Failures.List(),
+		"Hubs":      ui.Breaker.Status(),
+		"States":    ui.States.All(),
+		"Results":   ui.Results.List(hubitatservice.ResultFilter{Limit: dashboardResults}),
+		"Unmatched": ui.unmatched(),
 	})
 	if err != nil {
 		http.Error(w, "Error rendering dashboard", http.StatusInternalServerError)
@@ -99,42 +153,37 @@ func (ui *UIService) dashboardHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug().Msgf("Dashboard rendered with %d actions and %d devices", len(actions), len(devices))
 }
 
+func (ui *UIService) unmatched() []UnmatchedDetection {
+	if ui.Unmatched == nil {
+		return nil
+	}
+	return ui.Unmatched()
+}
+
 func (ui *UIService) actionHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		mode := r.URL.Query().Get("mode")
 		ui.actionsMutex.Lock()
 		defer ui.actionsMutex.Unlock()
-		actions, _ := ui.loadActions()
+		actions, err := ui.loadActions()
+		if err != nil {
+			log.Error().Msgf("Failed to load actions: %v", err)
+			http.Error(w, "Failed to load actions", http.StatusInternalServerError)
+			return
+		}
 		if mode == "add" {
-			deviceID, ok := ui.parseIntField(r.FormValue("deviceId"), "deviceId", w)
+			newAction, ok := ui.actionFromForm(r, w)
 			if !ok {
-				log.Error().Msg("Failed to parse deviceId for action add")
-				http.Error(w, "Invalid deviceId", http.StatusBadRequest)
-				return
-			}
-			delay, ok := ui.parseIntField(r.FormValue("delay"), "delay", w)
-			if !ok {
-				log.Error().Msg("Failed to parse delay for action add")
-				http.Error(w, "Invalid delay", http.StatusBadRequest)
+				log.Error().Msg("Failed to parse action add")
 				return
 			}
-			backoffPtr, ok := ui.parseDurationPtr(r.FormValue("backoff"), "backoff", w)
-			if !ok {
-				log.Error().Msg("Failed to parse backoff for action add")
-				http.Error(w, "Invalid backoff", http.StatusBadRequest)
+			newAction.ID = hubitatservice.NewRuleID()
+			actions = append(actions, newAction)
+			if !ui.checkChange(w, actions, nil, nil) {
 				return
 			}
-			newAction := hubitatservice.ActionInput{
-				DeviceID:        deviceID,
-				Delay:           delay,
-				PrimaryAction:   r.FormValue("primaryAction"),
-				SecondaryAction: r.FormValue("secondaryAction"),
-				CameraSource:    r.FormValue("cameraSource"),
-				Backoff:         backoffPtr,
-			}
-			actions = append(actions, newAction)
-			err := ui.saveActions(actions)
+			err = ui.saveActions(actions)
 			if err != nil {
 				log.Error().Msgf("Failed to save actions: %v", err)
 				http.Error(w, "Failed to save actions", http.StatusInternalServerError)
@@ -147,84 +196,304 @@ func (ui *UIService) actionHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Action added"))
 		} else if mode == "edit" {
-			actionID, ok := ui.parseIntField(r.FormValue("deviceId"), "deviceId", w)
-			if !ok {
-				log.Error().Msg("Failed to parse deviceId for action edit")
-				http.Error(w, "Invalid deviceId", http.StatusBadRequest)
+			ruleID := r.FormValue("id")
+			i := hubitatservice.FindAction(actions, ruleID)
+			if i < 0 {
+				log.Error().Msgf("Action with id %s not found for edit", ruleID)
+				http.Error(w, "Action not found", http.StatusNotFound)
 				return
 			}
-			found := false
-			for i, a := range actions {
-				if a.DeviceID == actionID {
-					delay, ok := ui.parseIntField(r.FormValue("delay"), "delay", w)
-					if !ok {
-						log.Error().Msg("Failed to parse delay for action edit")
-						http.Error(w, "Invalid delay", http.StatusBadRequest)
-						return
-					}
-					backoffPtr, ok := ui.parseDurationPtr(r.FormValue("backoff"), "backoff", w)
-					if !ok {
-						log.Error().Msg("Failed to parse backoff for action edit")
-						http.Error(w, "Invalid backoff", http.StatusBadRequest)
-						return
-					}
-					actions[i].Delay = delay
-					actions[i].PrimaryAction = r.FormValue("primaryAction")
-					actions[i].SecondaryAction = r.FormValue("secondaryAction")
-					actions[i].CameraSource = r.FormValue("cameraSource")
-					actions[i].Backoff = backoffPtr
-					*ui.UpdateChannel <- UpdateMsg{
-						UpdateType: "action",
-						UpdateData: actions[i],
-					}
-					found = true
-					log.Info().Msgf("Action with deviceId %d updated", i)
-					break
-				}
+			edited, ok := ui.actionFromForm(r, w)
+			if !ok {
+				log.Error().Msg("Failed to parse action edit")
+				return
 			}
-			if !found {
-				log.Error().Msgf("Action with deviceId %d not found for edit", actionID)
-				http.Error(w, "Action not found", http.StatusNotFound)
+			// The rule's identity, file, and enabled and snooze state are not part of the form
+			edited.ID = actions[i].ID
+			edited.Source = actions[i].Source
+			edited.Enabled = actions[i].Enabled
+			edited.SnoozeUntil = actions[i].SnoozeUntil
+			actions[i] = edited
+			if !ui.checkChange(w, actions, nil, nil) {
 				return
 			}
-			err := ui.saveActions(actions)
+			err = ui.saveActions(actions)
 			if err != nil {
 				log.Error().Msgf("Failed to save actions: %v", err)
 				http.Error(w, "Failed to save actions", http.StatusInternalServerError)
 				return
-
 			}
+			*ui.UpdateChannel <- UpdateMsg{
+				UpdateType: "action",
+				UpdateData: actions[i],
+			}
+			log.Info().Msgf("Action with id %s updated", ruleID)
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Action updated"))
 		}
 	case "DELETE":
-		actionIDStr := r.URL.Query().Get("id")
-		actionID, err := strconv.Atoi(actionIDStr)
+		ruleID := r.URL.Query().Get("id")
+		ui.actionsMutex.Lock()
+		defer ui.actionsMutex.Unlock()
+		actions, err := ui.loadActions()
+		if err != nil {
+			log.Error().Msgf("Failed to load actions: %v", err)
+			http.Error(w, "Failed to load actions", http.StatusInternalServerError)
+			return
+		}
+		i := hubitatservice.FindAction(actions, ruleID)
+		if i < 0 {
+			log.Error().Msgf("Action with id %s not found for delete", ruleID)
+			http.Error(w, "Action not found", http.StatusNotFound)
+			return
+		}
+		deleted := actions[i]
+		actions = append(actions[:i], actions[i+1:]...)
+		// Other rules may refer to this one, e.g. a cancel of rule:<id>
+		if !ui.checkChange(w, actions, nil, nil) {
+			return
+		}
+		err = ui.saveActions(actions)
+		if err != nil {
+			log.Error().Msgf("Failed to save actions: %v", err)
+			http.Error(w, "Failed to save actions", http.StatusInternalServerError)
+			return
+		}
+		*ui.UpdateChannel <- UpdateMsg{
+			UpdateType: "action",
+			UpdateData: deleted,
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Action deleted"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// actionFromForm reads the editable rule fields from an add or edit form.
+// On failure the error response has already been written.
+func (ui *UIService) actionFromForm(r *http.Request, w http.ResponseWriter) (hubitatservice.ActionInput, bool) {
+	deviceID, ok := ui.parseOptionalIntField(r.FormValue("deviceId"), "deviceId", w)
+	if !ok {
+		return hubitatservice.ActionInput{}, false
+	}
+	delay, ok := ui.parseDurationField(r.FormValue("delay"), "delay", w)
+	if !ok {
+		return hubitatservice.ActionInput{}, false
+	}
+	backoff, ok := ui.parseDurationField(r.FormValue("backoff"), "backoff", w)
+	if !ok {
+		return hubitatservice.ActionInput{}, false
+	}
+	absentFor, ok := ui.parseDurationField(r.FormValue("absentFor"), "absentFor", w)
+	if !ok {
+		return hubitatservice.ActionInput{}, false
+	}
+	priority, ok := ui.parseOptionalIntField(r.FormValue("priority"), "priority", w)
+	if !ok {
+		return hubitatservice.ActionInput{}, false
+	}
+	return hubitatservice.ActionInput{
+		DeviceID:        deviceID,
+		Delay:           delay,
+		PrimaryAction:   r.FormValue("primaryAction"),
+		SecondaryAction: r.FormValue("secondaryAction"),
+		CameraSource:    r.FormValue("cameraSource"),
+		Backoff:         backoff,
+		Scene:           r.FormValue("scene"),
+		Retrigger:       r.FormValue("retrigger"),
+		AbsentFor:       absentFor,
+		Priority:        priority,
+		Conflict:        r.FormValue("conflict"),
+		When:            strings.TrimSpace(r.FormValue("when")),
+	}, true
+}
+
+// RuleCommand enables, disables, snoozes or unsnoozes the rule with the given ID in
+// the actions file, then asks the controller to reload the actions.
+func (ui *UIService) RuleCommand(ruleID string, command string, snooze time.Duration) error {
+	ui.actionsMutex.Lock()
+	defer ui.actionsMutex.Unlock()
+	actions, err := ui.loadActions()
+	if err != nil {
+		return err
+	}
+	index := hubitatservice.FindAction(actions, ruleID)
+	if index < 0 {
+		return fmt.Errorf("rule %s not found", ruleID)
+	}
+
+	switch command {
+	case RuleEnable:
+		actions[index].Enabled = nil
+	case RuleDisable:
+		disabled := false
+		actions[index].Enabled = &disabled
+	case RuleSnooze:
+		if snooze <= 0 {
+			return fmt.Errorf("snooze duration must be positive: %v", snooze)
+		}
+		until := time.Now().Add(snooze).Truncate(time.Second)
+		actions[index].SnoozeUntil = &until
+	case RuleUnsnooze:
+		actions[index].SnoozeUntil = nil
+	default:
+		return fmt.Errorf("unknown rule command: %v", command)
+	}
+
+	err = ui.saveActions(actions)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Rule %s for %v: %v", ruleID, actions[index].CameraSource, command)
+	*ui.UpdateChannel <- UpdateMsg{
+		UpdateType: "action",
+		UpdateData: actions[index],
+	}
+	return nil
+}
+
+// hubitatEventHandler takes the device events the Maker API POSTs to its postURL.
+// Hubitat cannot log in, so the URL carries SOFTRAINS_WEBHOOK_TOKEN as ?token=;
+// without that variable set the endpoint is off.
+func (ui *UIService) hubitatEventHandler(w http.ResponseWriter, r *http.Request) {
+	if ui.webhookToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(ui.webhookToken)) != 1 {
+		log.Warn().Msgf("Rejected Hubitat event from %v: bad token", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	event, err := hubitatservice.ParseMakerEvent(body, time.Now())
+	if err != nil {
+		log.Error().Msgf("Invalid Hubitat event: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	*ui.UpdateChannel <- UpdateMsg{
+		UpdateType: "hubitatEvent",
+		UpdateData: event,
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// stateAPIHandler lists the live state of every device a hub has reported on.
+func (ui *UIService) stateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ui.States.All())
+}
+
+// resultsAPIHandler lists action results, newest first. The query parameters device,
+// rule, failed=true and limit narrow the list.
+func (ui *UIService) resultsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter := hubitatservice.ResultFilter{
+		Rule:       query.Get("rule"),
+		FailedOnly: query.Get("failed") == "true",
+	}
+	if device := query.Get("device"); device != "" {
+		deviceID, err := strconv.Atoi(device)
+		if err != nil {
+			http.Error(w, "Invalid device", http.StatusBadRequest)
+			return
+		}
+		filter.DeviceID = &deviceID
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ui.Results.List(filter))
+}
+
+// failedAPIHandler lists failed actions and hub health on GET, and queues the failed
+// action given by the form field id again on POST.
+func (ui *UIService) failedAPIHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"failed": ui.Failures.List(),
+			"hubs":   ui.Breaker.Status(),
+		})
+	case "POST":
+		id, err := strconv.Atoi(r.FormValue("id"))
 		if err != nil {
-			log.Error().Msgf("Invalid id for action delete: %v", err)
+			log.Error().Msgf("Invalid failed action id: %v", err)
 			http.Error(w, "Invalid id", http.StatusBadRequest)
 			return
 		}
+		*ui.UpdateChannel <- UpdateMsg{
+			UpdateType: "retryFailed",
+			UpdateData: id,
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Action queued"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ruleAPIHandler lists rules with their state on GET, and applies a rule command on POST
+// using the form fields id, command and, for snooze, a duration in "for".
+func (ui *UIService) ruleAPIHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
 		ui.actionsMutex.Lock()
-		defer ui.actionsMutex.Unlock()
-		actions, _ := ui.loadActions()
-		var newActions []hubitatservice.ActionInput
-		found := false
-		for _, a := range actions {
-			if a.DeviceID != actionID {
-				newActions = append(newActions, a)
-			} else {
-				found = true
+		actions, err := ui.loadActions()
+		ui.actionsMutex.Unlock()
+		if err != nil {
+			log.Error().Msgf("Failed to load actions: %v", err)
+			http.Error(w, "Failed to load actions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(actions)
+	case "POST":
+		ruleID := r.FormValue("id")
+		command := r.FormValue("command")
+		var snooze time.Duration
+		if command == RuleSnooze {
+			d, err := time.ParseDuration(r.FormValue("for"))
+			if err != nil {
+				log.Error().Msgf("Invalid snooze duration: %v", err)
+				http.Error(w, "Invalid for", http.StatusBadRequest)
+				return
 			}
+			snooze = d
 		}
-		if !found {
-			log.Error().Msgf("Action with deviceId %d not found for delete", actionID)
-			http.Error(w, "Action not found", http.StatusNotFound)
+		err := ui.RuleCommand(ruleID, command, snooze)
+		if err != nil {
+			log.Error().Msgf("Rule command failed: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		ui.saveActions(newActions)
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Action deleted"))
+		w.Write([]byte("Rule updated"))
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -238,12 +507,22 @@ func (ui *UIService) deviceHandler(w http.ResponseWriter, r *http.Request) {
 		defer ui.configMutex.Unlock()
 		devices, _ := ui.loadDevices()
 		devUrl := r.FormValue("deviceUrl")
-		backOff, ok := ui.parseIntField(r.FormValue("deviceBackoff"), "deviceBackoff", w)
+		backOff, ok := ui.parseDurationField(r.FormValue("deviceBackoff"), "deviceBackoff", w)
 		if !ok {
 			log.Error().Msg("Failed to parse deviceBackoff")
 			http.Error(w, "Invalid deviceBackoff", http.StatusBadRequest)
 			return
 		}
+		qos, ok := ui.parseOptionalIntField(r.FormValue("qos"), "qos", w)
+		if !ok {
+			log.Error().Msg("Failed to parse qos")
+			return
+		}
+		if qos < 0 || qos > 2 {
+			http.Error(w, "Invalid qos, must be 0, 1 or 2", http.StatusBadRequest)
+			return
+		}
+		retain := r.FormValue("retain") == "true"
 		if mode == "add" {
 			deviceIDStr := r.FormValue("deviceId")
 			deviceID, err := strconv.Atoi(deviceIDStr)
@@ -258,17 +537,33 @@ func (ui *UIService) deviceHandler(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "Invalid apiID", http.StatusBadRequest)
 				return
 			}
-			devices[deviceIDStr] = hubitatservice.HubitatDeviceInfo{
+			device := hubitatservice.HubitatDeviceInfo{
 				DeviceID:      deviceID,
 				APIID:         apiID,
 				DeviceURL:     &devUrl,
 				DeviceBackoff: backOff,
+				Type:          r.FormValue("type"),
+				Topic:         r.FormValue("topic"),
+				QoS:           byte(qos),
+				Retain:        retain,
+				EntityID:      r.FormValue("entityId"),
+				Token:         r.FormValue("token"),
+			}
+			device.PostBody = postBodyFromForm(r, device)
+			devices[deviceIDStr] = device
+			if !ui.checkChange(w, nil, devices, nil) {
+				return
+			}
+			err = ui.saveDevices(devices)
+			if err != nil {
+				log.Error().Msgf("Failed to save devices: %v", err)
+				http.Error(w, "Failed to save devices", http.StatusInternalServerError)
+				return
 			}
 			*ui.UpdateChannel <- UpdateMsg{
 				UpdateType: "device",
 				UpdateData: devices[deviceIDStr],
 			}
-			ui.saveDevices(devices)
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Device added"))
 		} else if mode == "edit" {
@@ -283,12 +578,30 @@ func (ui *UIService) deviceHandler(w http.ResponseWriter, r *http.Request) {
 				dev.APIID = apiID
 				dev.DeviceURL = &devUrl
 				dev.DeviceBackoff = backOff
+				dev.Type = r.FormValue("type")
+				dev.Topic = r.FormValue("topic")
+				dev.QoS = byte(qos)
+				dev.Retain = retain
+				dev.EntityID = r.FormValue("entityId")
+				dev.PostBody = postBodyFromForm(r, dev)
+				// The token is never sent to the browser, so an empty field keeps it
+				if token := r.FormValue("token"); token != "" {
+					dev.Token = token
+				}
 				devices[deviceID] = dev
+				if !ui.checkChange(w, nil, devices, nil) {
+					return
+				}
+				err := ui.saveDevices(devices)
+				if err != nil {
+					log.Error().Msgf("Failed to save devices: %v", err)
+					http.Error(w, "Failed to save devices", http.StatusInternalServerError)
+					return
+				}
 				*ui.UpdateChannel <- UpdateMsg{
 					UpdateType: "device",
 					UpdateData: dev,
 				}
-				ui.saveDevices(devices)
 				w.WriteHeader(http.StatusOK)
 				w.Write([]byte("Device updated"))
 			} else {
@@ -313,7 +626,15 @@ func (ui *UIService) deviceHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		delete(devices, deviceID)
-		ui.saveDevices(devices)
+		if !ui.checkChange(w, nil, devices, nil) {
+			return
+		}
+		err := ui.saveDevices(devices)
+		if err != nil {
+			log.Error().Msgf("Failed to save devices: %v", err)
+			http.Error(w, "Failed to save devices", http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Device deleted"))
 	default:
@@ -321,15 +642,195 @@ func (ui *UIService) deviceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Helper functions to load/save JSON
+// postBodyFromForm reads a device's PostBody from the device form. An empty field
+// means no body, except for a webhook, which always posts one.
+func postBodyFromForm(r *http.Request, device hubitatservice.HubitatDeviceInfo) *string {
+	body := r.FormValue("postBody")
+	if body == "" && device.DeviceType() != hubitatservice.DeviceTypeWebhook {
+		return nil
+	}
+	return &body
+}
+
+func (ui *UIService) sceneHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		mode := r.URL.Query().Get("mode")
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			log.Error().Msg("Missing name for scene")
+			http.Error(w, "Missing name", http.StatusBadRequest)
+			return
+		}
+		if mode == "run" {
+			*ui.UpdateChannel <- UpdateMsg{
+				UpdateType: "sceneRun",
+				UpdateData: name,
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Scene started"))
+			return
+		}
+
+		commands, err := parseSceneCommands(r.FormValue("commands"))
+		if err != nil {
+			log.Error().Msgf("Invalid commands for scene %s: %v", name, err)
+			http.Error(w, "Invalid commands: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(commands) == 0 {
+			log.Error().Msgf("Scene %s has no commands", name)
+			http.Error(w, "Scene needs at least one command", http.StatusBadRequest)
+			return
+		}
+		ui.configMutex.Lock()
+		defer ui.configMutex.Unlock()
+		scenes, _ := ui.loadScenes()
+		if scenes == nil {
+			scenes = make(map[string]hubitatservice.Scene)
+		}
+		_, exists := scenes[name]
+		if mode == "add" && exists {
+			http.Error(w, "Scene already exists", http.StatusConflict)
+			return
+		}
+		if mode == "edit" && !exists {
+			log.Error().Msgf("Scene %s not found for edit", name)
+			http.Error(w, "Scene not found", http.StatusNotFound)
+			return
+		}
+		scenes[name] = hubitatservice.Scene{Name: name, Commands: commands}
+		if !ui.checkChange(w, nil, nil, scenes) {
+			return
+		}
+		err = ui.saveScenes(scenes)
+		if err != nil {
+			log.Error().Msgf("Failed to save scenes: %v", err)
+			http.Error(w, "Failed to save scenes", http.StatusInternalServerError)
+			return
+		}
+		*ui.UpdateChannel <- UpdateMsg{
+			UpdateType: "scene",
+			UpdateData: scenes[name],
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Scene saved"))
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		ui.configMutex.Lock()
+		defer ui.configMutex.Unlock()
+		scenes, _ := ui.loadScenes()
+		if _, ok := scenes[name]; !ok {
+			log.Error().Msgf("Scene %s not found for delete", name)
+			http.Error(w, "Scene not found", http.StatusNotFound)
+			return
+		}
+		delete(scenes, name)
+		if !ui.checkChange(w, nil, nil, scenes) {
+			return
+		}
+		err := ui.saveScenes(scenes)
+		if err != nil {
+			log.Error().Msgf("Failed to save scenes: %v", err)
+			http.Error(w, "Failed to save scenes", http.StatusInternalServerError)
+			return
+		}
+		// A scene without commands tells the controller to drop it
+		*ui.UpdateChannel <- UpdateMsg{
+			UpdateType: "scene",
+			UpdateData: hubitatservice.Scene{Name: name},
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Scene deleted"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseSceneCommands reads one command per line in the form:
+// deviceId, delay, primaryAction[, secondaryAction]
+func parseSceneCommands(text string) ([]hubitatservice.SceneCommand, error) {
+	var commands []hubitatservice.SceneCommand
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("line %d: expected deviceId, delay, primaryAction[, secondaryAction]", i+1)
+		}
+		for j := range fields {
+			fields[j] = strings.TrimSpace(fields[j])
+		}
+		deviceID, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid deviceId: %w", i+1, err)
+		}
+		delay, err := hubitatservice.ParseDuration(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid delay: %w", i+1, err)
+		}
+		command := hubitatservice.SceneCommand{
+			DeviceID:      deviceID,
+			Delay:         delay,
+			PrimaryAction: fields[2],
+		}
+		if len(fields) == 4 {
+			command.SecondaryAction = fields[3]
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+// checkChange validates the rules and HubitatConfig as they would be after a save.
+// Arguments left nil are read from disk. When there are problems it writes a 400
+// with the errors as JSON and reports false.
+func (ui *UIService) checkChange(w http.ResponseWriter, actions []hubitatservice.ActionInput, devices map[string]hubitatservice.HubitatDeviceInfo, scenes map[string]hubitatservice.Scene) bool {
+	if ui.Validate == nil {
+		return true
+	}
+	var errs hubitatservice.ValidationErrors
+	for key := range devices {
+		if _, err := strconv.Atoi(key); err != nil {
+			errs.Add(ui.ConfigPath, "HubitatConfig.HubitatDevices."+key, "device key must be a number")
+		}
+	}
+	var config hubitatservice.HubitatServiceConfig
+	var err error
+	if len(errs) == 0 {
+		config, err = ui.loadHubitatConfig(devices, scenes)
+		if err != nil {
+			errs.Add(ui.ConfigPath, "", "%v", err)
+		}
+	}
+	if actions == nil {
+		actions, err = ui.loadActions()
+		if err != nil {
+			errs.Add(ui.ActionsPath, "", "%v", err)
+		}
+	}
+	if len(errs) == 0 {
+		errs = ui.Validate(actions, config)
+	}
+	if len(errs) == 0 {
+		return true
+	}
+
+	log.Error().Msgf("Rejected change:\n%v", errs)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(errs)
+	return false
+}
+
+// Helper functions to load/save the JSON or YAML config files
 func (ui *UIService) loadActions() ([]hubitatservice.ActionInput, error) {
-	data, err := os.ReadFile(ui.ActionsPath)
+	actions, err := hubitatservice.LoadActions(ui.ActionsPath)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug().Msgf("file actions:\n%s", ui.prettyJSON(data))
-	var actions []hubitatservice.ActionInput
-	json.Unmarshal(data, &actions)
 	if b, err := json.MarshalIndent(actions, "", "  "); err == nil {
 		log.Debug().Msgf("loaded actions:\n%s", b)
 	}
@@ -337,15 +838,11 @@ func (ui *UIService) loadActions() ([]hubitatservice.ActionInput, error) {
 }
 
 func (ui *UIService) saveActions(actions []hubitatservice.ActionInput) error {
-	data, err := json.MarshalIndent(actions, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(ui.ActionsPath, data, 0644)
+	return hubitatservice.SaveActions(ui.ActionsPath, actions)
 }
 
 func (ui *UIService) loadDevices() (map[string]hubitatservice.HubitatDeviceInfo, error) {
-	data, err := os.ReadFile(ui.ConfigPath)
+	data, err := hubitatservice.ReadConfigFile(ui.ConfigPath)
 	if err != nil {
 		return nil, err
 	}
@@ -362,33 +859,96 @@ func (ui *UIService) loadDevices() (map[string]hubitatservice.HubitatDeviceInfo,
 	return config.HubitatConfig.HubitatDevices, nil
 }
 
+// loadHubitatConfig returns HubitatConfig as the controller would load it once the
+// given devices and scenes are saved. Those left nil are taken from the file.
+func (ui *UIService) loadHubitatConfig(devices map[string]hubitatservice.HubitatDeviceInfo, scenes map[string]hubitatservice.Scene) (hubitatservice.HubitatServiceConfig, error) {
+	data, err := hubitatservice.ReadConfigFile(ui.ConfigPath)
+	if err != nil {
+		return hubitatservice.HubitatServiceConfig{}, err
+	}
+	if devices != nil {
+		data, err = ui.setHubitatConfigValue(data, "HubitatDevices", devices)
+		if err != nil {
+			return hubitatservice.HubitatServiceConfig{}, err
+		}
+	}
+	if scenes != nil {
+		data, err = ui.setHubitatConfigValue(data, "Scenes", scenes)
+		if err != nil {
+			return hubitatservice.HubitatServiceConfig{}, err
+		}
+	}
+	if ui.LoadConfig != nil {
+		return ui.LoadConfig(data)
+	}
+	var config struct {
+		HubitatConfig hubitatservice.HubitatServiceConfig `json:"HubitatConfig"`
+	}
+	err = json.Unmarshal(data, &config)
+	return config.HubitatConfig, err
+}
+
 func (ui *UIService) saveDevices(devices map[string]hubitatservice.HubitatDeviceInfo) error {
-	data, err := os.ReadFile(ui.ConfigPath)
+	return ui.saveHubitatConfigValue("HubitatDevices", devices)
+}
+
+func (ui *UIService) loadScenes() (map[string]hubitatservice.Scene, error) {
+	data, err := hubitatservice.ReadConfigFile(ui.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		HubitatConfig struct {
+			Scenes map[string]hubitatservice.Scene `json:"Scenes"`
+		} `json:"HubitatConfig"`
+	}
+	json.Unmarshal(data, &config)
+	for name, scene := range config.HubitatConfig.Scenes {
+		scene.Name = name
+		config.HubitatConfig.Scenes[name] = scene
+	}
+	return config.HubitatConfig.Scenes, nil
+}
+
+func (ui *UIService) saveScenes(scenes map[string]hubitatservice.Scene) error {
+	return ui.saveHubitatConfigValue("Scenes", scenes)
+}
+
+// saveHubitatConfigValue replaces a single key under HubitatConfig in the config file,
+// leaving the rest of the file as it was.
+func (ui *UIService) saveHubitatConfigValue(key string, value interface{}) error {
+	data, err := hubitatservice.ReadConfigFile(ui.ConfigPath)
 	if err != nil {
 		return err
 	}
+	out, err := ui.setHubitatConfigValue(data, key, value)
+	if err != nil {
+		return err
+	}
+	return hubitatservice.WriteConfigFile(ui.ConfigPath, out)
+}
+
+// setHubitatConfigValue returns the config document with a single key under
+// HubitatConfig replaced.
+func (ui *UIService) setHubitatConfigValue(data []byte, key string, value interface{}) ([]byte, error) {
 	var config map[string]interface{}
 	if err := json.Unmarshal(data, &config); err != nil {
-		return err
+		return nil, err
 	}
 	hc, ok := config["HubitatConfig"].(map[string]interface{})
 	if !ok {
-		return err
-	}
-	devicesIface := make(map[string]interface{}, len(devices))
-	for k, v := range devices {
-		b, _ := json.Marshal(v)
-		var m map[string]interface{}
-		json.Unmarshal(b, &m)
-		devicesIface[k] = m
+		return nil, fmt.Errorf("HubitatConfig not found in %s", ui.ConfigPath)
 	}
-	hc["HubitatDevices"] = devicesIface
-
-	out, err := json.MarshalIndent(config, "", "  ")
+	b, err := json.Marshal(value)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return os.WriteFile(ui.ConfigPath, out, 0644)
+	var valueIface interface{}
+	if err := json.Unmarshal(b, &valueIface); err != nil {
+		return nil, err
+	}
+	hc[key] = valueIface
+	return json.MarshalIndent(config, "", "  ")
 }
 
 func (ui *UIService) prettyJSON(data []byte) string {
@@ -415,15 +975,184 @@ func (ui *UIService) parseIntField(val string, fieldName string, w http.Response
 	return i, true
 }
 
-func (ui *UIService) parseDurationPtr(val string, fieldName string, w http.ResponseWriter) (*time.Duration, bool) {
+// parseOptionalIntField is parseIntField for fields where empty means zero.
+func (ui *UIService) parseOptionalIntField(val string, fieldName string, w http.ResponseWriter) (int, bool) {
+	if val == "" {
+		return 0, true
+	}
+	return ui.parseIntField(val, fieldName, w)
+}
+
+// parseDurationField reads a duration such as "90s" or "5m", or a bare number of
+// seconds. An empty field is zero.
+func (ui *UIService) parseDurationField(val string, fieldName string, w http.ResponseWriter) (hubitatservice.Duration, bool) {
 	if val == "" {
-		return nil, true
+		return 0, true
 	}
-	d, err := time.ParseDuration(val)
+	d, err := hubitatservice.ParseDuration(val)
 	if err != nil {
 		log.Error().Msgf("Invalid %s: %v", fieldName, err)
 		http.Error(w, "Invalid "+fieldName, http.StatusBadRequest)
-		return nil, false
+		return 0, false
+	}
+	return d, true
+}
+
+// HubDeviceStatus is a device found on a hub and how it stands against the config:
+// "new", "imported", or the reason it cannot be imported.
+type HubDeviceStatus struct {
+	hubitatservice.HubDevice
+	Status string
+}
+
+// hubsAPIHandler imports devices from the Maker API. GET without parameters lists
+// the configured hubs, GET with hub=<APIId> lists that hub's devices, and POST with
+// hub and one id field per device imports them into the config.
+func (ui *UIService) hubsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("hub") == "" {
+			json.NewEncoder(w).Encode(ui.hubs())
+			return
+		}
+		hub, ok := ui.findHub(w, r.URL.Query().Get("hub"))
+		if !ok {
+			return
+		}
+		found, err := hub.FetchDevices()
+		if err != nil {
+			log.Error().Msgf("Failed to list devices on hub %v: %v", hub.APIID, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		devices, _ := ui.loadDevices()
+		list := make([]HubDeviceStatus, 0, len(found))
+		for _, device := range found {
+			existing, exists := devices[strconv.Itoa(device.ID)]
+			status := "new"
+			if _, err := hub.ImportDevice(device, existing, exists); err != nil {
+				status = err.Error()
+			} else if exists {
+				status = "imported"
+			}
+			list = append(list, HubDeviceStatus{HubDevice: device, Status: status})
+		}
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		r.ParseForm()
+		hub, ok := ui.findHub(w, r.FormValue("hub"))
+		if !ok {
+			return
+		}
+		selected := make(map[string]bool)
+		for _, id := range r.Form["id"] {
+			selected[id] = true
+		}
+		if len(selected) == 0 {
+			http.Error(w, "No devices selected", http.StatusBadRequest)
+			return
+		}
+		found, err := hub.FetchDevices()
+		if err != nil {
+			log.Error().Msgf("Failed to list devices on hub %v: %v", hub.APIID, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		ui.configMutex.Lock()
+		defer ui.configMutex.Unlock()
+		devices, _ := ui.loadDevices()
+		if devices == nil {
+			devices = make(map[string]hubitatservice.HubitatDeviceInfo)
+		}
+		var imported []hubitatservice.HubitatDeviceInfo
+		configured := ui.configuredHub(hub)
+		for _, device := range found {
+			key := strconv.Itoa(device.ID)
+			if !selected[key] {
+				continue
+			}
+			existing, exists := devices[key]
+			entry, err := configured.ImportDevice(device, existing, exists)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			devices[key] = entry
+			imported = append(imported, entry)
+		}
+		if len(imported) == 0 {
+			http.Error(w, "None of the selected devices were found on the hub", http.StatusBadRequest)
+			return
+		}
+		if !ui.checkChange(w, nil, devices, nil) {
+			return
+		}
+		err = ui.saveDevices(devices)
+		if err != nil {
+			log.Error().Msgf("Failed to save devices: %v", err)
+			http.Error(w, "Failed to save devices", http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range imported {
+			*ui.UpdateChannel <- UpdateMsg{
+				UpdateType: "device",
+				UpdateData: entry,
+			}
+		}
+		log.Info().Msgf("Imported %d devices from hub %v", len(imported), hub.APIID)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Imported %d devices", len(imported))))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ui *UIService) hubs() []hubitatservice.HubConfig {
+	if ui.Hubs == nil {
+		return nil
+	}
+	return ui.Hubs()
+}
+
+// configuredHub returns the hub as it is written in the config file, with its ${...}
+// references unexpanded, so the device URLs it imports keep them rather than the
+// resolved host. A hub only set from the environment is returned as it is.
+func (ui *UIService) configuredHub(hub hubitatservice.HubConfig) hubitatservice.HubConfig {
+	data, err := hubitatservice.ReadConfigFile(ui.ConfigPath)
+	if err != nil {
+		return hub
+	}
+	var config struct {
+		HubitatConfig struct {
+			Hubs []hubitatservice.HubConfig `json:"Hubs"`
+		} `json:"HubitatConfig"`
+	}
+	if json.Unmarshal(data, &config) != nil {
+		return hub
+	}
+	for _, configured := range config.HubitatConfig.Hubs {
+		if configured.APIID == hub.APIID {
+			return configured
+		}
+	}
+	log.Warn().Msgf("Hub %v is not in %v, imported device URLs use its expanded URL", hub.APIID, ui.ConfigPath)
+	return hub
+}
+
+// findHub looks up a configured hub by APIId, writing an error when there is none.
+func (ui *UIService) findHub(w http.ResponseWriter, value string) (hubitatservice.HubConfig, bool) {
+	apiID, err := strconv.Atoi(value)
+	if err != nil {
+		http.Error(w, "Invalid hub", http.StatusBadRequest)
+		return hubitatservice.HubConfig{}, false
+	}
+	for _, hub := range ui.hubs() {
+		if hub.APIID == apiID {
+			return hub, true
+		}
 	}
-	return &d, true
+	http.Error(w, "Hub not found", http.StatusNotFound)
+	return hubitatservice.HubConfig{}, false
 }